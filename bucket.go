@@ -0,0 +1,302 @@
+package flowdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"sort"
+)
+
+const (
+	// defaultBucket holds the keys written through FlowDB.Get and FlowDB.Put
+	defaultBucket uint16 = 0
+
+	bucketFileName = "buckets.json"
+)
+
+// bucketMeta is the persisted bucket registry. Ids are never reused, and a
+// dropped id is remembered until Merge has removed its entries from disk.
+type bucketMeta struct {
+	NextID  uint16            `json:"next_id"`
+	Buckets map[string]uint16 `json:"buckets"`
+	Dropped []uint16          `json:"dropped"`
+}
+
+func newBucketMeta() bucketMeta {
+	return bucketMeta{
+		NextID:  defaultBucket + 1,
+		Buckets: make(map[string]uint16),
+	}
+}
+
+func (m *bucketMeta) isDropped(id uint16) bool {
+	for _, dropped := range m.Dropped {
+		if dropped == id {
+			return true
+		}
+	}
+	return false
+}
+
+// BucketStats describes the live entries of a bucket
+type BucketStats struct {
+	Keys int64
+	Size int64
+}
+
+func (s *BucketStats) add(record *KeyDirRecord) {
+	s.Keys++
+	s.Size += int64(record.ValueSize)
+}
+
+func (s *BucketStats) remove(record *KeyDirRecord) {
+	s.Keys--
+	s.Size -= int64(record.ValueSize)
+}
+
+// Bucket is a named keyspace inside a FlowDB. Keys of different buckets never
+// collide.
+type Bucket struct {
+	name string
+	db   *FlowDB
+}
+
+// CreateBucket registers a new bucket called name.
+func (f *FlowDB) CreateBucket(name string) (*Bucket, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.buckets.Buckets[name]; ok {
+		return nil, ErrBucketExists
+	}
+	if _, err := f.createBucket(name); err != nil {
+		return nil, err
+	}
+	return &Bucket{name: name, db: f}, nil
+}
+
+// createBucket registers a new bucket and returns its id. The caller must
+// hold f.mu.
+func (f *FlowDB) createBucket(name string) (uint16, error) {
+	if err := f.writable(); err != nil {
+		return 0, err
+	}
+	if name == "" {
+		return 0, fmt.Errorf("%w: empty bucket name", ErrInvalidArgument)
+	}
+	if f.buckets.NextID == math.MaxUint16 {
+		return 0, fmt.Errorf("%w: too many buckets", ErrInvalidArgument)
+	}
+	id := f.buckets.NextID
+	f.buckets.Buckets[name] = id
+	f.buckets.NextID++
+	return id, f.saveBuckets()
+}
+
+// DropBucket forgets the bucket called name and all of its keys. The space
+// they take on disk is reclaimed by the next Merge.
+func (f *FlowDB) DropBucket(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.writable(); err != nil {
+		return err
+	}
+	id, ok := f.buckets.Buckets[name]
+	if !ok {
+		return ErrBucketNotFound
+	}
+	delete(f.buckets.Buckets, name)
+	f.buckets.Dropped = append(f.buckets.Dropped, id)
+	if err := f.saveBuckets(); err != nil {
+		return err
+	}
+
+	f.keydir.removeIf(func(record *KeyDirRecord) bool {
+		return record.bucket == id
+	})
+	delete(f.bucketStats, id)
+
+	return nil
+}
+
+// Bucket returns a handle on the bucket called name. Its methods fail if the
+// bucket does not exist.
+func (f *FlowDB) Bucket(name string) *Bucket {
+	return &Bucket{name: name, db: f}
+}
+
+// Buckets returns the names of all buckets in order.
+func (f *FlowDB) Buckets() []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	names := make([]string, 0, len(f.buckets.Buckets))
+	for name := range f.buckets.Buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (b *Bucket) Name() string {
+	return b.name
+}
+
+func (b *Bucket) Get(key []byte) ([]byte, error) {
+	b.db.mu.RLock()
+	defer b.db.mu.RUnlock()
+
+	id, err := b.id()
+	if err != nil {
+		return nil, err
+	}
+	return b.db.get(id, key)
+}
+
+func (b *Bucket) Put(key, value []byte) error {
+	b.db.mu.RLock()
+	defer b.db.mu.RUnlock()
+
+	id, err := b.id()
+	if err != nil {
+		return err
+	}
+	return b.db.put(id, key, value)
+}
+
+func (b *Bucket) Delete(key []byte) error {
+	b.db.mu.RLock()
+	defer b.db.mu.RUnlock()
+
+	id, err := b.id()
+	if err != nil {
+		return err
+	}
+	return b.db.delete(id, key)
+}
+
+// Stats returns the number and encoded size of the live keys in the bucket.
+func (b *Bucket) Stats() (BucketStats, error) {
+	b.db.mu.RLock()
+	defer b.db.mu.RUnlock()
+	b.db.writeMu.Lock()
+	defer b.db.writeMu.Unlock()
+
+	id, err := b.id()
+	if err != nil {
+		return BucketStats{}, err
+	}
+	if stats, ok := b.db.bucketStats[id]; ok {
+		return *stats, nil
+	}
+	return BucketStats{}, nil
+}
+
+// id resolves the bucket name. The caller must hold b.db.mu.
+func (b *Bucket) id() (uint16, error) {
+	id, ok := b.db.buckets.Buckets[b.name]
+	if !ok {
+		return 0, ErrBucketNotFound
+	}
+	return id, nil
+}
+
+// stats returns the stats of bucket, creating them on first use.
+func (f *FlowDB) stats(bucket uint16) *BucketStats {
+	stats, ok := f.bucketStats[bucket]
+	if !ok {
+		stats = &BucketStats{}
+		f.bucketStats[bucket] = stats
+	}
+	return stats
+}
+
+func (f *FlowDB) loadBuckets() error {
+	data, err := readFile(f.options.FS, path.Join(f.options.DatabaseDirectory, bucketFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	meta := newBucketMeta()
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return err
+	}
+	if meta.Buckets == nil {
+		meta.Buckets = make(map[string]uint16)
+	}
+	f.buckets = meta
+	return nil
+}
+
+// saveBuckets writes the registry through a temporary file so a crash leaves
+// either the old or the new version behind.
+func (f *FlowDB) saveBuckets() error {
+	data, err := json.Marshal(f.buckets)
+	if err != nil {
+		return err
+	}
+	file := path.Join(f.options.DatabaseDirectory, bucketFileName)
+	if err := writeFile(f.options.FS, file+".tmp", data, FM); err != nil {
+		return err
+	}
+	return f.options.FS.Rename(file+".tmp", file)
+}
+
+// keyHash returns the keydir slot of key inside bucket.
+func (f *FlowDB) keyHash(bucket uint16, key []byte) uint64 {
+	return bucketKeyHash(f.options.Hasher, bucket, key)
+}
+
+// hintKeyHash returns the hash a hint file of version records for key
+// inside bucket.
+func (f *FlowDB) hintKeyHash(version uint16, bucket uint16, key []byte) uint64 {
+	if version < formatV4 {
+		return prefixedKeyHash(f.options.Hasher, bucket, key)
+	}
+	return f.keyHash(bucket, key)
+}
+
+// bucketDomain moves the hashes of keys outside the default bucket away from
+// those of default keys
+const bucketDomain uint64 = 0x9e3779b97f4a7c15
+
+// bucketKeyHash hashes key inside bucket with h. Keys of the default bucket
+// hash on their own so existing hints keep their meaning. The keys of other
+// buckets hash behind their bucket id, and that hash is mixed once more: the
+// prefixed key on its own can be written as a default key, "\x00\x01k" for
+// "k" in bucket 1, while matching the mixed hash takes a hash collision.
+func bucketKeyHash(h Hasher, bucket uint16, key []byte) uint64 {
+	if bucket == defaultBucket {
+		return h.Sum64(key)
+	}
+	return mix64(prefixedKeyHash(h, bucket, key) ^ bucketDomain)
+}
+
+// prefixedKeyHash is how files before v4 hashed keys of every bucket.
+func prefixedKeyHash(h Hasher, bucket uint16, key []byte) uint64 {
+	if bucket == defaultBucket {
+		return h.Sum64(key)
+	}
+	buf := make([]byte, 2+len(key))
+	buf[0] = byte(bucket >> 8)
+	buf[1] = byte(bucket)
+	copy(buf[2:], key)
+	return h.Sum64(buf)
+}
+
+// mix64 is the murmur3 finalizer, a bijection that spreads every input bit
+// over the output.
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,124 @@
+package flowdb
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestBucket(t *testing.T) {
+	dir := t.TempDir()
+	db := New(dir)
+	require.NoError(t, db.Load())
+
+	users, err := db.CreateBucket("users")
+	require.NoError(t, err)
+	orders, err := db.CreateBucket("orders")
+	require.NoError(t, err)
+	_, err = db.CreateBucket("users")
+	require.Error(t, err)
+
+	require.NoError(t, db.Put([]byte("k"), []byte("default")))
+	require.NoError(t, users.Put([]byte("k"), []byte("user")))
+	require.NoError(t, orders.Put([]byte("k"), []byte("order")))
+	require.NoError(t, orders.Put([]byte("k2"), []byte("order")))
+
+	value, err := db.Get([]byte("k"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("default"), value)
+	value, err = db.Bucket("users").Get([]byte("k"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("user"), value)
+
+	stats, err := orders.Stats()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), stats.Keys)
+
+	require.NoError(t, db.DropBucket("orders"))
+	_, err = orders.Get([]byte("k"))
+	require.Error(t, err)
+	require.Equal(t, []string{"users"}, db.Buckets())
+	require.NoError(t, db.Close())
+
+	// the dropped bucket stays dropped across a restart
+	db = New(dir)
+	require.NoError(t, db.Load())
+	value, err = db.Bucket("users").Get([]byte("k"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("user"), value)
+	_, err = db.Bucket("orders").Get([]byte("k"))
+	require.Error(t, err)
+
+	require.NoError(t, db.Merge())
+	value, err = db.Get([]byte("k"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("default"), value)
+	require.NoError(t, db.Close())
+
+	// merged files recover to the same state
+	db = New(dir)
+	require.NoError(t, db.Load())
+	stats, err = db.Bucket("users").Stats()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), stats.Keys)
+	require.Equal(t, 1, len(db.dataFileIds()))
+	require.NoError(t, db.Close())
+}
+
+func TestBucketKeysDoNotCollide(t *testing.T) {
+	dir := t.TempDir()
+	db := New(dir)
+	require.NoError(t, db.Load())
+
+	// the default key spells out bucket 1 and "k" the way they are hashed
+	users, err := db.CreateBucket("users")
+	require.NoError(t, err)
+	require.NotEqual(t, db.keyHash(defaultBucket, []byte("\x00\x01k")), db.keyHash(1, []byte("k")))
+
+	require.NoError(t, db.Put([]byte("\x00\x01k"), []byte("default")))
+	_, err = users.Get([]byte("k"))
+	require.Equal(t, ErrKeyNotFound, err)
+	require.NoError(t, users.Put([]byte("k"), []byte("user")))
+	require.NoError(t, db.Close())
+
+	db = New(dir)
+	require.NoError(t, db.Load())
+	value, err := db.Get([]byte("\x00\x01k"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("default"), value)
+	value, err = db.Bucket("users").Get([]byte("k"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("user"), value)
+	require.NoError(t, db.Close())
+}
+
+type constHasher struct{}
+
+func (constHasher) Name() string            { return "const" }
+func (constHasher) Sum64(key []byte) uint64 { return 0 }
+
+func TestLookupChecksKey(t *testing.T) {
+	// every key hashes alike, so the keydir slot of b holds a
+	db := NewWithOptions(Options{DatabaseDirectory: "db", FS: NewMemFS(), Hasher: constHasher{}})
+	require.NoError(t, db.Load())
+	require.NoError(t, db.Put([]byte("a"), []byte("1")))
+	_, err := db.Get([]byte("b"))
+	require.Equal(t, ErrKeyNotFound, err)
+	_, errs := db.MultiGet([][]byte{[]byte("b")})
+	require.Equal(t, ErrKeyNotFound, errs[0])
+	ok, err := db.CompareAndSwap([]byte("b"), []byte("1"), []byte("2"))
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// deleting b leaves a alone, and b is still absent
+	require.NoError(t, db.Delete([]byte("b")))
+	value, err := db.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), value)
+	ok, err = db.PutIfAbsent([]byte("b"), []byte("2"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	value, err = db.Get([]byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), value)
+	require.NoError(t, db.Close())
+}
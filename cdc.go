@@ -0,0 +1,348 @@
+package flowdb
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Position is a point in the stream of mutations. A zero Position is the
+// start of the oldest data file. FileId and Offset point right after the
+// mutation last read; RaftIndex is the raft log that wrote it, when the
+// database is driven by the FSM.
+type Position struct {
+	FileId    int64
+	Offset    int64
+	RaftIndex uint64
+}
+
+// Mutation is a write read back from the data files
+type Mutation struct {
+	Position  Position
+	Type      EventType
+	DataType  DataType
+	Bucket    uint16
+	Key       []byte
+	Value     []byte
+	Timestamp int64
+}
+
+// CDCReader tails the data files in order and returns every mutation with the
+// position to resume from. Merge keeps the files an open reader has yet to
+// read until it is done with them, and the reader skips the copies Merge made
+// of their entries, so it sees every mutation once across a Merge. Merge
+// removes the files a closed reader's Position points into; a reader started
+// from such a Position fails with ErrPositionLost.
+type CDCReader struct {
+	db *FlowDB
+
+	// pos follows the last mutation returned, readPos the last entry read.
+	// readPos is guarded by db.cdcMu.
+	pos     Position
+	readPos Position
+	pending []*Mutation
+	// after skips the raft logs a reader resuming by index has already seen
+	after uint64
+}
+
+// mergedFile is a data file Merge removed while an open reader still had to
+// read it. resume is where the stream goes on after the newest file of a
+// Merge, past the copies it made.
+type mergedFile struct {
+	fd      File
+	version uint16
+	size    int64
+	resume  Position
+}
+
+// NewCDCReader returns a reader starting after from. A Position with only
+// RaftIndex set scans from the start and skips the logs up to that index.
+// The reader holds on to files Merge removes until it is closed.
+func (f *FlowDB) NewCDCReader(from Position) *CDCReader {
+	r := &CDCReader{
+		db:      f,
+		pos:     from,
+		readPos: from,
+		after:   from.RaftIndex,
+	}
+
+	f.cdcMu.Lock()
+	defer f.cdcMu.Unlock()
+	f.cdcReaders[r] = struct{}{}
+	return r
+}
+
+// Close stops the reader. Its Position stays valid until the next Merge.
+func (r *CDCReader) Close() {
+	r.db.cdcMu.Lock()
+	defer r.db.cdcMu.Unlock()
+
+	delete(r.db.cdcReaders, r)
+	r.db.releaseMergedFiles()
+}
+
+// Next returns the next mutation, or io.EOF once the reader has caught up with
+// the writers. Next can be called again after io.EOF to pick up new writes.
+func (r *CDCReader) Next() (*Mutation, error) {
+	for len(r.pending) == 0 {
+		if err := r.fill(); err != nil {
+			return nil, err
+		}
+	}
+	m := r.pending[0]
+	r.pending = r.pending[1:]
+	r.pos = m.Position
+	return m, nil
+}
+
+// Position returns where a new reader has to start to pick up after the
+// last mutation returned by Next.
+func (r *CDCReader) Position() Position {
+	return r.pos
+}
+
+// fill reads entries until it has mutations to hand out. Under the FSM every
+// command is followed by an entry recording its raft index, so mutations are
+// held back until that entry tells which log they belong to. Only the end of
+// the active file is looked up under f.writeMu; the entries are read without
+// holding up the writers.
+func (r *CDCReader) fill() error {
+	f := r.db
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.writeMu.Lock()
+	limit := Position{FileId: f.dataFileVersion, Offset: f.activeFileOffset}
+	f.writeMu.Unlock()
+
+	clustered := f.keydir.get(f.keyHash(raftBucket, appliedIndexKey)) != nil
+	f.cdcMu.Lock()
+	readPos := r.readPos
+	f.cdcMu.Unlock()
+	defer func() {
+		r.advance(readPos)
+	}()
+
+	pos := readPos
+	var group []*Mutation
+	for {
+		entry, next, err := f.nextEntry(pos, limit)
+		if err != nil {
+			return err
+		}
+		pos = next
+
+		if entry.Bucket == raftBucket {
+			index := binary.BigEndian.Uint64(entry.Value)
+			readPos = pos
+			if index <= r.after {
+				group = group[:0]
+				continue
+			}
+			for _, m := range group {
+				m.Position.RaftIndex = index
+			}
+			if len(group) > 0 {
+				group[len(group)-1].Position = pos
+				group[len(group)-1].Position.RaftIndex = index
+				r.pending = group
+				return nil
+			}
+			continue
+		}
+
+		m := &Mutation{
+			Position:  pos,
+			Type:      EventPut,
+			DataType:  entry.Type,
+			Bucket:    entry.Bucket,
+			Key:       entry.Key,
+			Value:     entry.Value,
+			Timestamp: int64(entry.Timestamp),
+		}
+		if entry.Flags&flagTombstone != 0 {
+			m.Type = EventDelete
+		}
+		if !clustered {
+			readPos = pos
+			r.pending = []*Mutation{m}
+			return nil
+		}
+		group = append(group, m)
+	}
+}
+
+// advance moves the reader on to pos, letting go of the files removed by
+// Merge that it was the last to need.
+func (r *CDCReader) advance(pos Position) {
+	r.db.cdcMu.Lock()
+	defer r.db.cdcMu.Unlock()
+
+	if pos != r.readPos {
+		r.readPos = pos
+		r.db.releaseMergedFiles()
+	}
+}
+
+// nextEntry reads the entry at pos, moving on to the next data file at the
+// end of one, and stops with io.EOF at limit. It returns the entry and the
+// position right after it. The caller must hold f.mu.
+func (f *FlowDB) nextEntry(pos, limit Position) (*Entry, Position, error) {
+	if pos.FileId == 0 {
+		pos = Position{FileId: f.nextStreamFileId(0)}
+	}
+	for {
+		if pos.FileId == 0 || pos.FileId > limit.FileId {
+			return nil, pos, io.EOF
+		}
+		fd, version, end, resume, err := f.cdcFile(pos.FileId, limit)
+		if err != nil {
+			return nil, pos, err
+		}
+		if version != formatV1 && pos.Offset < fileHeaderSize {
+			pos.Offset = fileHeaderSize
+		}
+		if pos.Offset >= end {
+			if resume.FileId != 0 {
+				pos = resume
+			} else {
+				pos = Position{FileId: f.nextStreamFileId(pos.FileId)}
+			}
+			continue
+		}
+
+		header := make([]byte, entryHeaderSize)
+		if _, err := fd.ReadAt(header, pos.Offset); err != nil {
+			return nil, pos, err
+		}
+		keySize, valueSize, _ := decodeEntryHeaderVersion(version, header)
+		data := make([]byte, entryHeaderSize+keySize+valueSize)
+		if _, err := fd.ReadAt(data, pos.Offset); err != nil {
+			return nil, pos, err
+		}
+		entry := decodeEntryVersion(version, data)
+		if entry == nil {
+			return nil, pos, ErrCorrupt
+		}
+		return entry, Position{FileId: pos.FileId, Offset: pos.Offset + int64(len(data))}, nil
+	}
+}
+
+// cdcFile returns data file id, live or kept for readers after Merge, with
+// its format version and where its entries end as of limit. For a file kept
+// after Merge it also returns where the stream resumes after it.
+func (f *FlowDB) cdcFile(id int64, limit Position) (File, uint16, int64, Position, error) {
+	f.cdcMu.Lock()
+	merged, ok := f.mergedFiles[id]
+	f.cdcMu.Unlock()
+	if ok {
+		return merged.fd, merged.version, merged.size, merged.resume, nil
+	}
+
+	fd, version, ok := f.dataFile(id)
+	if !ok {
+		return nil, 0, 0, Position{}, ErrPositionLost
+	}
+	if id == limit.FileId {
+		return fd, version, limit.Offset, Position{}, nil
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		return nil, 0, 0, Position{}, err
+	}
+	return fd, version, info.Size(), Position{}, nil
+}
+
+// nextStreamFileId returns the smallest id above id of a data file, live or
+// kept for readers after Merge, or 0 if there is none.
+func (f *FlowDB) nextStreamFileId(id int64) int64 {
+	next := f.nextFileId(id)
+
+	f.cdcMu.Lock()
+	defer f.cdcMu.Unlock()
+	for fileId := range f.mergedFiles {
+		if fileId > id && (next == 0 || fileId < next) {
+			next = fileId
+		}
+	}
+	return next
+}
+
+// keepMergedFile holds on to data file id, which Merge is removing, if an
+// open reader has yet to read it, and reports whether it did. resume is set
+// for the newest file of the Merge. The caller must hold f.mu exclusively.
+func (f *FlowDB) keepMergedFile(id int64, fd File, version uint16, resume Position) (bool, error) {
+	f.cdcMu.Lock()
+	defer f.cdcMu.Unlock()
+
+	if !f.cdcNeeds(id) {
+		return false, nil
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		return false, err
+	}
+	f.mergedFiles[id] = &mergedFile{fd: fd, version: version, size: info.Size(), resume: resume}
+	return true, nil
+}
+
+// cdcNeeds reports whether an open reader has entries of data file id left
+// to read. Readers read in order of file id, so one that got past id never
+// comes back to it; one still at the zero Position needs every file. The
+// caller must hold f.cdcMu.
+func (f *FlowDB) cdcNeeds(id int64) bool {
+	for r := range f.cdcReaders {
+		if r.readPos.FileId == 0 || r.readPos.FileId <= id {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseMergedFiles closes the files kept after Merge that no open reader
+// needs any more. The caller must hold f.cdcMu.
+func (f *FlowDB) releaseMergedFiles() {
+	for id, merged := range f.mergedFiles {
+		if !f.cdcNeeds(id) {
+			_ = merged.fd.Close()
+			delete(f.mergedFiles, id)
+		}
+	}
+}
+
+// closeMergedFiles closes every file kept after Merge, on Close.
+func (f *FlowDB) closeMergedFiles() {
+	f.cdcMu.Lock()
+	defer f.cdcMu.Unlock()
+
+	for id, merged := range f.mergedFiles {
+		_ = merged.fd.Close()
+		delete(f.mergedFiles, id)
+	}
+}
+
+// nextFileId returns the smallest data file id above id, or 0 if there is
+// none.
+func (f *FlowDB) nextFileId(id int64) int64 {
+	for _, fileId := range f.openFileIds() {
+		if fileId > id {
+			return fileId
+		}
+	}
+	return 0
+}
+
+// fileEnd returns the end of the data written to a data file. The caller
+// must hold f.writeMu or f.mu exclusively.
+func (f *FlowDB) fileEnd(fileId int64) (int64, error) {
+	if fileId == f.dataFileVersion {
+		return f.activeFileOffset, nil
+	}
+	fd, _, ok := f.dataFile(fileId)
+	if !ok {
+		return 0, ErrCorrupt
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
@@ -0,0 +1,113 @@
+package flowdb
+
+import (
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+)
+
+func TestCDCReader(t *testing.T) {
+	db := New(t.TempDir())
+	require.NoError(t, db.Load())
+
+	require.NoError(t, db.Put([]byte("a"), []byte("1")))
+	require.NoError(t, db.Put([]byte("b"), []byte("2")))
+
+	r := db.NewCDCReader(Position{})
+	m, err := r.Next()
+	require.NoError(t, err)
+	require.Equal(t, EventPut, m.Type)
+	require.Equal(t, []byte("a"), m.Key)
+	resume := r.Position()
+	r.Close()
+
+	// a reader started from the saved position sees the rest exactly once
+	require.NoError(t, db.Delete([]byte("a")))
+	r = db.NewCDCReader(resume)
+	m, err = r.Next()
+	require.NoError(t, err)
+	require.Equal(t, []byte("b"), m.Key)
+	m, err = r.Next()
+	require.NoError(t, err)
+	require.Equal(t, EventDelete, m.Type)
+	require.Equal(t, []byte("a"), m.Key)
+	_, err = r.Next()
+	require.Equal(t, io.EOF, err)
+
+	// new writes show up after EOF, across file rotation
+	db.mu.Lock()
+	require.NoError(t, db.rotateActiveFile())
+	db.mu.Unlock()
+	require.NoError(t, db.Put([]byte("c"), []byte("3")))
+	m, err = r.Next()
+	require.NoError(t, err)
+	require.Equal(t, []byte("c"), m.Key)
+
+	// open readers keep going through a merge without seeing its copies
+	lagging := db.NewCDCReader(resume)
+	fromStart := db.NewCDCReader(Position{})
+	require.NoError(t, db.Merge())
+	require.NoError(t, db.Put([]byte("d"), []byte("4")))
+	var keys []string
+	for {
+		m, err := lagging.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		keys = append(keys, string(m.Key))
+	}
+	require.Equal(t, []string{"b", "a", "c", "d"}, keys)
+	var events []string
+	for {
+		m, err := fromStart.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		events = append(events, string(m.Key)+"="+string(m.Value))
+	}
+	require.Equal(t, []string{"a=1", "b=2", "a=", "c=3", "d=4"}, events)
+	m, err = r.Next()
+	require.NoError(t, err)
+	require.Equal(t, []byte("d"), m.Key)
+	_, err = r.Next()
+	require.Equal(t, io.EOF, err)
+	r.Close()
+	lagging.Close()
+	fromStart.Close()
+	require.Empty(t, db.mergedFiles)
+
+	// merge removes the files a closed reader's position points into
+	require.NoError(t, db.Merge())
+	_, err = db.NewCDCReader(resume).Next()
+	require.Equal(t, ErrPositionLost, err)
+	require.NoError(t, db.Close())
+}
+
+func TestCDCReaderRaftIndex(t *testing.T) {
+	db := New(t.TempDir())
+	require.NoError(t, db.Load())
+	fsm := NewFSM(db)
+	for i, key := range []string{"a", "b", "c"} {
+		data, err := EncodeCommand(&Command{Op: OpPut, Key: []byte(key), Value: []byte("v")})
+		require.NoError(t, err)
+		fsm.Apply(&raft.Log{Index: uint64(i + 1), Data: data})
+	}
+
+	r := db.NewCDCReader(Position{})
+	m, err := r.Next()
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), m.Key)
+	require.Equal(t, uint64(1), m.Position.RaftIndex)
+
+	r = db.NewCDCReader(Position{RaftIndex: 2})
+	m, err = r.Next()
+	require.NoError(t, err)
+	require.Equal(t, []byte("c"), m.Key)
+	require.Equal(t, uint64(3), m.Position.RaftIndex)
+	_, err = r.Next()
+	require.Equal(t, io.EOF, err)
+	require.NoError(t, db.Close())
+}
@@ -1,18 +1,59 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
+	"github.com/tsundata/flowdb"
 	"github.com/tsundata/flowdb/network"
 	"io"
 	"log"
 	"net"
-	"time"
+	"strconv"
 )
 
 var (
 	serverAddr string
 )
 
+var errUsage = errors.New("usage: flowdb-client [--server_addr=addr] command key [args...]")
+
+// variadic marks commands taking one or more arguments after the key
+const variadic = -1
+
+// commands maps a command name to its op, the number of arguments after the
+// key and how to fill them into the command
+var commands = map[string]struct {
+	op    flowdb.CommandOp
+	args  int
+	parse func(*flowdb.Command, []string) error
+}{
+	"get":      {flowdb.OpGet, 0, nil},
+	"put":      {flowdb.OpPut, 1, setValue},
+	"delete":   {flowdb.OpDelete, 0, nil},
+	"cas":      {flowdb.OpCompareAndSwap, 2, setOldValue},
+	"putnx":    {flowdb.OpPutIfAbsent, 1, setValue},
+	"delifeq":  {flowdb.OpDeleteIfEquals, 1, setValue},
+	"incr":     {flowdb.OpIncrBy, 0, setDelta(1)},
+	"decr":     {flowdb.OpIncrBy, 0, setDelta(-1)},
+	"incrby":   {flowdb.OpIncrBy, 1, parseDelta},
+	"lpush":    {flowdb.OpLPush, variadic, setMembers},
+	"rpush":    {flowdb.OpRPush, variadic, setMembers},
+	"lpop":     {flowdb.OpLPop, 0, nil},
+	"rpop":     {flowdb.OpRPop, 0, nil},
+	"lrange":   {flowdb.OpLRange, 2, parseRange},
+	"hset":     {flowdb.OpHSet, 2, setFieldValue},
+	"hget":     {flowdb.OpHGet, 1, setField},
+	"hdel":     {flowdb.OpHDel, 1, setField},
+	"hgetall":  {flowdb.OpHGetAll, 0, nil},
+	"sadd":     {flowdb.OpSAdd, variadic, setMembers},
+	"srem":     {flowdb.OpSRem, variadic, setMembers},
+	"smembers": {flowdb.OpSMembers, 0, nil},
+	"zadd":     {flowdb.OpZAdd, 2, parseScoreMember},
+	"zrem":     {flowdb.OpZRem, 1, setValue},
+	"zrange":   {flowdb.OpZRange, 2, parseRange},
+}
+
 func main() {
 	flag.StringVar(&serverAddr, "server_addr", "127.0.0.1:7000", "server addr")
 	flag.Parse()
@@ -21,46 +62,160 @@ func main() {
 		panic("error server addr")
 	}
 
+	c, err := parseCommand(flag.Args())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	data, err := flowdb.EncodeCommand(c)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	conn, err := net.Dial("tcp", serverAddr)
 	if err != nil {
 		panic(err)
 	}
+	defer conn.Close()
 
-	for {
-		// write
-		pack := network.NewPack()
-		msg, _ := pack.Pack(network.NewMessage(1, []byte(time.Now().String())))
-		_, err := conn.Write(msg)
-		if err != nil {
-			log.Println(err)
-			return
-		}
+	// write
+	pack := network.NewPack()
+	msg, _ := pack.Pack(network.NewMessage(uint32(c.Op), data))
+	_, err = conn.Write(msg)
+	if err != nil {
+		log.Println(err)
+		return
+	}
 
-		// read
-		headData := make([]byte, pack.GetHeadLen())
-		_, err = io.ReadFull(conn, headData)
-		if err != nil {
-			log.Println(err)
-			break
-		}
-		head, err := pack.Unpack(headData)
-		if err != nil {
-			log.Println(err)
-			return
+	// read
+	headData := make([]byte, pack.GetHeadLen())
+	_, err = io.ReadFull(conn, headData)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	head, err := pack.Unpack(headData)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	reply := head.(*network.Message)
+	reply.Data = make([]byte, reply.GetDataLen())
+	_, err = io.ReadFull(conn, reply.Data)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	status, data, err := flowdb.DecodeReply(reply.Data)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if status != flowdb.StatusOK {
+		log.Fatalf("recv ID: %d status %d (%s): %s", reply.ID, status, status, data)
+	}
+	log.Printf("recv ID: %d LEN: %d DATA: %s", reply.ID, len(data), data)
+
+	// commands returning several values reply with a JSON array
+	var values [][]byte
+	if listReplies[c.Op] && json.Unmarshal(data, &values) == nil {
+		for _, value := range values {
+			log.Printf("%s", value)
 		}
+	}
+}
 
-		if head.GetDataLen() > 0 {
-			msg := head.(*network.Message)
-			msg.Data = make([]byte, msg.GetDataLen())
+var listReplies = map[flowdb.CommandOp]bool{
+	flowdb.OpLRange:   true,
+	flowdb.OpHGetAll:  true,
+	flowdb.OpSMembers: true,
+	flowdb.OpZRange:   true,
+}
 
-			_, err := io.ReadFull(conn, msg.Data)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			log.Printf("recv ID: %d LEN: %d DATA: %s", msg.ID, msg.DataLen, msg.Data)
+// parseCommand turns `name key [args...]` into a command
+func parseCommand(args []string) (*flowdb.Command, error) {
+	if len(args) < 2 {
+		return nil, errUsage
+	}
+	spec, ok := commands[args[0]]
+	if !ok {
+		return nil, errUsage
+	}
+	rest := args[2:]
+	if (spec.args == variadic && len(rest) == 0) || (spec.args != variadic && len(rest) != spec.args) {
+		return nil, errUsage
+	}
+
+	c := &flowdb.Command{Op: spec.op, Key: []byte(args[1])}
+	if spec.parse != nil {
+		if err := spec.parse(c, rest); err != nil {
+			return nil, err
 		}
+	}
+	return c, nil
+}
+
+func setValue(c *flowdb.Command, args []string) error {
+	c.Value = []byte(args[0])
+	return nil
+}
 
-		time.Sleep(time.Second)
+// setOldValue reads the expected value before the new one
+func setOldValue(c *flowdb.Command, args []string) error {
+	c.Old = []byte(args[0])
+	c.Value = []byte(args[1])
+	return nil
+}
+
+func setDelta(delta int64) func(*flowdb.Command, []string) error {
+	return func(c *flowdb.Command, args []string) error {
+		c.Delta = delta
+		return nil
+	}
+}
+
+func parseDelta(c *flowdb.Command, args []string) error {
+	delta, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return err
+	}
+	c.Delta = delta
+	return nil
+}
+
+func setMembers(c *flowdb.Command, args []string) error {
+	for _, arg := range args {
+		c.Members = append(c.Members, []byte(arg))
+	}
+	return nil
+}
+
+func setField(c *flowdb.Command, args []string) error {
+	c.Field = []byte(args[0])
+	return nil
+}
+
+func setFieldValue(c *flowdb.Command, args []string) error {
+	c.Field = []byte(args[0])
+	c.Value = []byte(args[1])
+	return nil
+}
+
+func parseRange(c *flowdb.Command, args []string) error {
+	var err error
+	if c.Start, err = strconv.ParseInt(args[0], 10, 64); err != nil {
+		return err
+	}
+	c.Stop, err = strconv.ParseInt(args[1], 10, 64)
+	return err
+}
+
+func parseScoreMember(c *flowdb.Command, args []string) error {
+	score, err := strconv.ParseFloat(args[0], 64)
+	if err != nil {
+		return err
 	}
+	c.Score = score
+	c.Value = []byte(args[1])
+	return nil
 }
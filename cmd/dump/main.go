@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"github.com/tsundata/flowdb"
+	"log"
+	"os"
+)
+
+var (
+	dbDir  string
+	format string
+	output string
+)
+
+func main() {
+	flag.StringVar(&dbDir, "db_dir", "", "database directory to dump")
+	flag.StringVar(&format, "format", flowdb.FormatJSONLines, "output format, jsonl or csv")
+	flag.StringVar(&output, "out", "", "output file, stdout if empty")
+	flag.Parse()
+
+	if dbDir == "" {
+		log.Fatalln("usage: flowdb-dump --db_dir <directory> [--format jsonl|csv] [--out file]")
+	}
+
+	count, err := run()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("dumped %d keys", count)
+}
+
+// run dumps the database without changing it. The output file is written
+// under a temporary name and only renamed once the dump is complete, so a
+// failed dump leaves no file behind that looks whole.
+func run() (int, error) {
+	db, err := flowdb.OpenReadOnly(dbDir)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	if output == "" {
+		return db.Export(os.Stdout, format)
+	}
+	tmp := output + ".tmp"
+	fd, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	count, err := db.Export(fd, format)
+	if err == nil {
+		err = fd.Sync()
+	}
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return 0, err
+	}
+	return count, os.Rename(tmp, output)
+}
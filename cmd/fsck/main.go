@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/tsundata/flowdb"
+	"log"
+	"os"
+)
+
+var dbDir string
+
+func main() {
+	flag.StringVar(&dbDir, "db_dir", "", "database directory to check")
+	flag.Parse()
+
+	if dbDir == "" {
+		log.Fatalln("usage: flowdb-fsck --db_dir <directory>")
+	}
+
+	report, err := flowdb.Fsck(dbDir)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, file := range report.Files {
+		fmt.Printf("%d.data: version %d, %d bytes, %d entries, %d hints\n",
+			file.FileId, file.Version, file.Size, file.Entries, file.Hints)
+	}
+	for _, r := range report.Corrupt {
+		fmt.Printf("corrupt: %s [%d, %d): %s\n", r.File, r.Start, r.End, r.Reason)
+	}
+	for _, orphan := range report.Orphans {
+		fmt.Printf("orphan: %s\n", orphan)
+	}
+	fmt.Printf("%d keys\n", report.Keys)
+
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"github.com/tsundata/flowdb"
+	"io"
+	"log"
+	"os"
+)
+
+var (
+	dbDir  string
+	format string
+	input  string
+	batch  int
+)
+
+func main() {
+	flag.StringVar(&dbDir, "db_dir", "", "database directory to load into")
+	flag.StringVar(&format, "format", flowdb.FormatJSONLines, "input format, jsonl or csv")
+	flag.StringVar(&input, "in", "", "input file, stdin if empty")
+	flag.IntVar(&batch, "batch", 1000, "records written per batch")
+	flag.Parse()
+
+	if dbDir == "" {
+		log.Fatalln("usage: flowdb-load --db_dir <directory> [--format jsonl|csv] [--in file] [--batch n]")
+	}
+
+	count, err := run()
+	if err != nil {
+		log.Fatalf("loaded %d keys: %v", count, err)
+	}
+	log.Printf("loaded %d keys", count)
+}
+
+// run loads the input into the database, closing it before returning so the
+// batches written are flushed even when a later one fails.
+func run() (count int, err error) {
+	db := flowdb.New(dbDir)
+	if err := db.Load(); err != nil {
+		return 0, err
+	}
+	defer func() {
+		if closeErr := db.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	var r io.Reader = os.Stdin
+	if input != "" {
+		fd, err := os.Open(input)
+		if err != nil {
+			return 0, err
+		}
+		defer fd.Close()
+		r = fd
+	}
+	return db.Import(r, format, batch)
+}
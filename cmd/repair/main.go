@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/tsundata/flowdb"
+	"log"
+)
+
+var dbDir string
+
+func main() {
+	flag.StringVar(&dbDir, "db_dir", "", "database directory to repair")
+	flag.Parse()
+
+	if dbDir == "" {
+		log.Fatalln("usage: flowdb-repair --db_dir <directory>")
+	}
+
+	report, err := flowdb.Repair(dbDir)
+	if report != nil {
+		for _, id := range report.Rewritten {
+			fmt.Printf("rewrote %d.data\n", id)
+		}
+		for _, id := range report.Rehinted {
+			fmt.Printf("regenerated %d.hint\n", id)
+		}
+		for _, r := range report.Lost {
+			fmt.Printf("lost: %s [%d, %d): %s\n", r.File, r.Start, r.End, r.Reason)
+		}
+		for _, file := range report.Quarantined {
+			fmt.Printf("quarantined: %s\n", file)
+		}
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Printf("%d bytes lost, %d keys\n", report.LostBytes, report.Keys)
+}
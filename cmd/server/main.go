@@ -41,7 +41,12 @@ func main() {
 		panic(err)
 	}
 
-	rf, _, err := flowdb.NewRaft(network.Setting.Raft.Addr, network.Setting.Raft.Id, raftDir)
+	db := flowdb.New(dbDir)
+	if err := db.Load(); err != nil {
+		panic(err)
+	}
+
+	rf, _, err := flowdb.NewRaft(network.Setting.Raft.Addr, network.Setting.Raft.Id, raftDir, db)
 	if err != nil {
 		panic(err)
 	}
@@ -51,13 +56,18 @@ func main() {
 
 	server := network.NewServer()
 
-	server.AddRouter(0, &GetRouter{rf: rf})
-	server.AddRouter(1, &PutRouter{rf: rf})
+	for op := flowdb.OpGet; op <= flowdb.OpZRange; op++ {
+		if op.IsWrite() {
+			server.AddRouter(uint32(op), &ApplyRouter{rf: rf})
+		} else {
+			server.AddRouter(uint32(op), &QueryRouter{db: db})
+		}
+	}
 
-	server.Serve()
+	server.Start()
 
 	// close
-	sig := make(chan os.Signal)
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	<-sig
 
@@ -67,39 +77,64 @@ func main() {
 	if err := shutdownFuture.Error(); err != nil {
 		log.Println("raft shutdown error", err)
 	}
+	if err := db.Close(); err != nil {
+		log.Println("db close error", err)
+	}
 	log.Println("kv server shutdown")
 }
 
-type GetRouter struct {
-	rf *raft.Raft
-	network.BaseRouter
+// decodeRequest reads the command of req and checks it matches the message id
+func decodeRequest(req network.IRequest) (*flowdb.Command, error) {
+	c, err := flowdb.DecodeCommand(req.GetData())
+	if err != nil {
+		return nil, err
+	}
+	if uint32(c.Op) != req.GetMessageID() {
+		return nil, fmt.Errorf("%w: command does not match message id", flowdb.ErrInvalidArgument)
+	}
+	return c, nil
 }
 
-func (r *GetRouter) Handle(req network.IRequest) {
-	log.Println("call get router Handle")
-	err := req.GetConnection().SendMessage(1, []byte("ping\n"))
+func reply(req network.IRequest, data []byte) {
+	err := req.GetConnection().SendMessage(req.GetMessageID(), data)
 	if err != nil {
 		log.Println(err)
 	}
 }
 
-type PutRouter struct {
+// QueryRouter serves read commands from the local database
+type QueryRouter struct {
+	db *flowdb.FlowDB
+	network.BaseRouter
+}
+
+func (r *QueryRouter) Handle(req network.IRequest) {
+	log.Println("call query router Handle")
+	c, err := decodeRequest(req)
+	if err != nil {
+		reply(req, flowdb.EncodeError(err))
+		return
+	}
+	reply(req, flowdb.EncodeResult(r.db.Query(c)))
+}
+
+// ApplyRouter replicates write commands through raft and replies with their
+// result once applied
+type ApplyRouter struct {
 	rf *raft.Raft
 	network.BaseRouter
 }
 
-func (r *PutRouter) Handle(req network.IRequest) {
-	log.Println("call put router Handle")
-	future := r.rf.Apply([]byte("test"), 5*time.Second)
-	if err := future.Error(); err != nil {
-		err := req.GetConnection().SendMessage(1, []byte(err.Error()+"\n"))
-		if err != nil {
-			log.Println(err)
-		}
+func (r *ApplyRouter) Handle(req network.IRequest) {
+	log.Println("call apply router Handle")
+	if _, err := decodeRequest(req); err != nil {
+		reply(req, flowdb.EncodeError(err))
 		return
 	}
-	err := req.GetConnection().SendMessage(1, []byte("ping\n"))
+	result, err := flowdb.Apply(r.rf, req.GetData(), 5*time.Second)
 	if err != nil {
-		log.Println(err)
+		reply(req, flowdb.EncodeError(err))
+		return
 	}
+	reply(req, flowdb.EncodeResult(result))
 }
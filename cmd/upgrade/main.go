@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/tsundata/flowdb"
+	"log"
+)
+
+var dbDir string
+
+func main() {
+	flag.StringVar(&dbDir, "db_dir", "", "database directory to upgrade")
+	flag.Parse()
+
+	if dbDir == "" {
+		log.Fatalln("usage: flowdb-upgrade --db_dir <directory>")
+	}
+
+	report, err := flowdb.Upgrade(dbDir)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if report.UpToDate {
+		fmt.Printf("%s is already in the current format\n", dbDir)
+		return
+	}
+	fmt.Printf("upgraded %d files, %d entries, %d keys\n", report.Files, report.Entries, report.Keys)
+	fmt.Printf("backup kept at %s\n", report.Backup)
+}
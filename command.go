@@ -0,0 +1,212 @@
+package flowdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// CommandOp identifies an operation. It doubles as the network message id of
+// the request carrying the command.
+type CommandOp uint32
+
+const (
+	OpGet CommandOp = iota
+	OpPut
+	OpDelete
+	OpCompareAndSwap
+	OpPutIfAbsent
+	OpDeleteIfEquals
+	OpIncrBy
+	OpLPush
+	OpRPush
+	OpLPop
+	OpRPop
+	OpLRange
+	OpHSet
+	OpHGet
+	OpHDel
+	OpHGetAll
+	OpSAdd
+	OpSRem
+	OpSMembers
+	OpZAdd
+	OpZRem
+	OpZRange
+)
+
+// readOps are served by the node receiving them instead of the raft log
+var readOps = map[CommandOp]bool{
+	OpGet:      true,
+	OpLRange:   true,
+	OpHGet:     true,
+	OpHGetAll:  true,
+	OpSMembers: true,
+	OpZRange:   true,
+}
+
+// Command is an operation sent by clients and replicated through the raft
+// log. Members carries the values of list pushes and set changes, Value the
+// member of sorted set changes.
+type Command struct {
+	Op      CommandOp `json:"op"`
+	Key     []byte    `json:"key"`
+	Value   []byte    `json:"value,omitempty"`
+	Old     []byte    `json:"old,omitempty"`
+	Delta   int64     `json:"delta,omitempty"`
+	Field   []byte    `json:"field,omitempty"`
+	Members [][]byte  `json:"members,omitempty"`
+	Score   float64   `json:"score,omitempty"`
+	Start   int64     `json:"start,omitempty"`
+	Stop    int64     `json:"stop,omitempty"`
+}
+
+// ApplyResult is what the FSM returns for an applied command. Values is set
+// by the commands returning several values.
+type ApplyResult struct {
+	Value  []byte
+	Values [][]byte
+	Ok     bool
+	Err    error
+}
+
+func EncodeCommand(c *Command) ([]byte, error) {
+	return json.Marshal(c)
+}
+
+func DecodeCommand(data []byte) (*Command, error) {
+	var c Command
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidArgument, err)
+	}
+	if len(c.Key) == 0 {
+		return nil, errEmptyKey
+	}
+	return &c, nil
+}
+
+// IsWrite reports whether the operation changes the database and so has to
+// go through the raft log.
+func (op CommandOp) IsWrite() bool {
+	return !readOps[op]
+}
+
+func (c *Command) IsWrite() bool {
+	return c.Op.IsWrite()
+}
+
+// Query runs a read command against the local copy of the database.
+func (f *FlowDB) Query(c *Command) *ApplyResult {
+	if c.IsWrite() {
+		return &ApplyResult{Err: fmt.Errorf("%w: not a read command", ErrInvalidArgument)}
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.execute(c)
+}
+
+// execute runs c against the database. The caller must hold f.mu, along
+// with f.writeMu unless c is a read.
+func (f *FlowDB) execute(c *Command) *ApplyResult {
+	var result ApplyResult
+	switch c.Op {
+	case OpGet:
+		result.Value, result.Err = f.get(defaultBucket, c.Key)
+		result.Ok = result.Err == nil
+	case OpPut:
+		result.Err = f.putLocked(defaultBucket, c.Key, c.Value, TypeString)
+		result.Ok = result.Err == nil
+	case OpDelete:
+		result.Err = f.deleteLocked(defaultBucket, c.Key)
+		result.Ok = result.Err == nil
+	case OpCompareAndSwap:
+		result.Ok, result.Err = f.compareAndSwap(defaultBucket, c.Key, c.Old, c.Value)
+	case OpPutIfAbsent:
+		result.Ok, result.Err = f.putIfAbsent(defaultBucket, c.Key, c.Value)
+	case OpDeleteIfEquals:
+		result.Ok, result.Err = f.deleteIfEquals(defaultBucket, c.Key, c.Value)
+	case OpIncrBy:
+		var n int64
+		n, result.Err = f.incrBy(defaultBucket, c.Key, c.Delta)
+		if result.Err == nil {
+			result.Value = []byte(strconv.FormatInt(n, 10))
+			result.Ok = true
+		}
+	case OpLPush, OpRPush:
+		var n int
+		n, result.Err = f.push(defaultBucket, c.Key, c.Members, c.Op == OpLPush)
+		result.setCount(n)
+	case OpLPop, OpRPop:
+		result.Value, result.Err = f.pop(defaultBucket, c.Key, c.Op == OpLPop)
+		result.Ok = result.Err == nil
+	case OpLRange:
+		result.Values, result.Err = f.lrange(defaultBucket, c.Key, c.Start, c.Stop)
+		result.Ok = result.Err == nil
+	case OpHSet:
+		result.Ok, result.Err = f.hset(defaultBucket, c.Key, c.Field, c.Value)
+	case OpHGet:
+		result.Value, result.Err = f.hget(defaultBucket, c.Key, c.Field)
+		result.Ok = result.Err == nil
+	case OpHDel:
+		result.Ok, result.Err = f.hdel(defaultBucket, c.Key, c.Field)
+	case OpHGetAll:
+		var hash map[string][]byte
+		hash, result.Err = f.loadHash(defaultBucket, c.Key)
+		if result.Err == nil {
+			result.Values, _ = decodeItems(encodeHash(hash))
+			if result.Values == nil {
+				result.Values = [][]byte{}
+			}
+			result.Ok = true
+		}
+	case OpSAdd:
+		var n int
+		n, result.Err = f.sadd(defaultBucket, c.Key, c.Members)
+		result.setCount(n)
+	case OpSRem:
+		var n int
+		n, result.Err = f.srem(defaultBucket, c.Key, c.Members)
+		result.setCount(n)
+	case OpSMembers:
+		result.Values, result.Err = f.smembers(defaultBucket, c.Key)
+		result.Ok = result.Err == nil
+	case OpZAdd:
+		result.Ok, result.Err = f.zadd(defaultBucket, c.Key, c.Score, c.Value)
+	case OpZRem:
+		result.Ok, result.Err = f.zrem(defaultBucket, c.Key, c.Value)
+	case OpZRange:
+		result.Values, result.Err = f.zrange(defaultBucket, c.Key, c.Start, c.Stop)
+		result.Ok = result.Err == nil
+	default:
+		result.Err = fmt.Errorf("%w: unknown command", ErrInvalidArgument)
+	}
+	return &result
+}
+
+// EncodeResult frames the reply to a command from its result: the error, the
+// values as a JSON array, the value, or whether the command took effect.
+func EncodeResult(result *ApplyResult) []byte {
+	switch {
+	case result.Err != nil:
+		return EncodeError(result.Err)
+	case result.Values != nil:
+		data, err := json.Marshal(result.Values)
+		if err != nil {
+			return EncodeError(err)
+		}
+		return EncodeReply(StatusOK, data)
+	case result.Value != nil:
+		return EncodeReply(StatusOK, result.Value)
+	default:
+		return EncodeReply(StatusOK, []byte(strconv.FormatBool(result.Ok)))
+	}
+}
+
+func (r *ApplyResult) setCount(n int) {
+	if r.Err == nil {
+		r.Value = []byte(strconv.Itoa(n))
+		r.Ok = true
+	}
+}
@@ -0,0 +1,71 @@
+package flowdb
+
+import "bytes"
+
+// CompareAndSwap replaces the value of key with new if it currently equals
+// old. It reports whether the swap happened.
+func (f *FlowDB) CompareAndSwap(key, old, new []byte) (bool, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	return f.compareAndSwap(defaultBucket, key, old, new)
+}
+
+// PutIfAbsent stores value under key unless key already exists. It reports
+// whether the value was stored.
+func (f *FlowDB) PutIfAbsent(key, value []byte) (bool, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	return f.putIfAbsent(defaultBucket, key, value)
+}
+
+// DeleteIfEquals removes key if its value equals value. It reports whether
+// the key was removed.
+func (f *FlowDB) DeleteIfEquals(key, value []byte) (bool, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	return f.deleteIfEquals(defaultBucket, key, value)
+}
+
+// compareAndSwap, putIfAbsent and deleteIfEquals check the current value and
+// write in one go. The caller must hold f.writeMu or f.mu exclusively.
+func (f *FlowDB) compareAndSwap(bucket uint16, key, old, new []byte) (bool, error) {
+	ok, err := f.valueEquals(bucket, key, old)
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, f.putLocked(bucket, key, new, TypeString)
+}
+
+func (f *FlowDB) putIfAbsent(bucket uint16, key, value []byte) (bool, error) {
+	entry, err := f.lookup(bucket, key)
+	if err != nil || entry != nil {
+		return false, err
+	}
+	return true, f.putLocked(bucket, key, value, TypeString)
+}
+
+func (f *FlowDB) deleteIfEquals(bucket uint16, key, value []byte) (bool, error) {
+	ok, err := f.valueEquals(bucket, key, value)
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, f.deleteLocked(bucket, key)
+}
+
+// valueEquals reports whether key exists and holds value.
+func (f *FlowDB) valueEquals(bucket uint16, key, value []byte) (bool, error) {
+	entry, err := f.lookup(bucket, key)
+	if err != nil || entry == nil {
+		return false, err
+	}
+	return entry.Type == TypeString && bytes.Equal(entry.Value, value), nil
+}
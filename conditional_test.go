@@ -0,0 +1,42 @@
+package flowdb
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestConditionalWrites(t *testing.T) {
+	db := New(t.TempDir())
+	require.NoError(t, db.Load())
+
+	ok, err := db.PutIfAbsent([]byte("leader"), []byte("node1"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = db.PutIfAbsent([]byte("leader"), []byte("node2"))
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	ok, err = db.CompareAndSwap([]byte("leader"), []byte("node2"), []byte("node3"))
+	require.NoError(t, err)
+	require.False(t, ok)
+	ok, err = db.CompareAndSwap([]byte("leader"), []byte("node1"), []byte("node3"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	value, err := db.Get([]byte("leader"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("node3"), value)
+
+	ok, err = db.DeleteIfEquals([]byte("leader"), []byte("node1"))
+	require.NoError(t, err)
+	require.False(t, ok)
+	ok, err = db.DeleteIfEquals([]byte("leader"), []byte("node3"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	_, err = db.Get([]byte("leader"))
+	require.Error(t, err)
+
+	ok, err = db.CompareAndSwap([]byte("leader"), nil, []byte("node1"))
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.NoError(t, db.Close())
+}
@@ -0,0 +1,54 @@
+package flowdb
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Incr adds one to the counter stored under key and returns the new value.
+func (f *FlowDB) Incr(key []byte) (int64, error) {
+	return f.IncrBy(key, 1)
+}
+
+// Decr subtracts one from the counter stored under key and returns the new
+// value.
+func (f *FlowDB) Decr(key []byte) (int64, error) {
+	return f.IncrBy(key, -1)
+}
+
+// IncrBy adds delta to the counter stored under key and returns the new
+// value. Counters are kept as decimal strings, and a missing key counts
+// as zero.
+func (f *FlowDB) IncrBy(key []byte, delta int64) (int64, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	return f.incrBy(defaultBucket, key, delta)
+}
+
+// incrBy reads the counter and writes the new value in one go. The caller
+// must hold f.writeMu or f.mu exclusively.
+func (f *FlowDB) incrBy(bucket uint16, key []byte, delta int64) (int64, error) {
+	entry, err := f.lookup(bucket, key)
+	if err != nil {
+		return 0, err
+	}
+	var current int64
+	if entry != nil {
+		current, err = strconv.ParseInt(string(entry.Value), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w: value is not an integer", ErrWrongType)
+		}
+	}
+
+	next := current + delta
+	if (delta > 0 && next < current) || (delta < 0 && next > current) {
+		return 0, fmt.Errorf("%w: increment would overflow", ErrInvalidArgument)
+	}
+	if err := f.putLocked(bucket, key, []byte(strconv.FormatInt(next, 10)), TypeString); err != nil {
+		return 0, err
+	}
+	return next, nil
+}
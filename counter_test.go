@@ -0,0 +1,35 @@
+package flowdb
+
+import (
+	"github.com/stretchr/testify/require"
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	db := New(t.TempDir())
+	require.NoError(t, db.Load())
+
+	n, err := db.Incr([]byte("seq"))
+	require.NoError(t, err)
+	require.Equal(t, int64(1), n)
+	n, err = db.IncrBy([]byte("seq"), 10)
+	require.NoError(t, err)
+	require.Equal(t, int64(11), n)
+	n, err = db.Decr([]byte("seq"))
+	require.NoError(t, err)
+	require.Equal(t, int64(10), n)
+	value, err := db.Get([]byte("seq"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("10"), value)
+
+	require.NoError(t, db.Put([]byte("name"), []byte("flow")))
+	_, err = db.Incr([]byte("name"))
+	require.Error(t, err)
+
+	require.NoError(t, db.Put([]byte("max"), []byte(strconv.FormatInt(math.MaxInt64, 10))))
+	_, err = db.Incr([]byte("max"))
+	require.Error(t, err)
+	require.NoError(t, db.Close())
+}
@@ -1,12 +1,12 @@
 package flowdb
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
-	"io/fs"
-	"io/ioutil"
-	"log"
+	"math"
 	"os"
 	"path"
 	"sort"
@@ -24,36 +24,141 @@ const (
 	defaultMaxFileSize int64 = 2 << 8 << 20
 )
 
+// FlowDB takes three locks, always in this order. mu is held shared by single
+// key reads and writes and exclusively by everything that has to see or change
+// the database as a whole. writeMu serializes appends to the active file along
+// with the bookkeeping done for each write: bucket stats, secondary indexes and
+// watcher events. Writes that read the key first, like CompareAndSwap, IncrBy
+// or LPush, hold it from the read to the write; holding mu exclusively keeps
+// writers out as well. filesMu guards fileList, fileVersions and the manifest,
+// which rotation changes under writeMu while readers look files up. The keydir
+// locks its shards itself.
 type FlowDB struct {
-	mu sync.RWMutex
+	mu      sync.RWMutex
+	writeMu sync.Mutex
+	filesMu sync.RWMutex
 
-	activeFile       *os.File
+	activeFile       File
+	activeHintFile   File
 	activeFileOffset int64
-	indexMap         map[uint64]*KeyDirRecord
-	fileList         map[int64]*os.File
+	activeHintOffset int64
+	keydir           *keydir
+	fileList         map[int64]File
+	fileVersions     map[int64]uint16
 	dataFileVersion  int64
 
+	buckets     bucketMeta
+	bucketStats map[uint16]*BucketStats
+	manifest    manifest
+
+	// diskUsage, activeReserve and readOnly are guarded like the active
+	// file. activeReserve is where the space preallocated for the active
+	// file ends.
+	diskUsage     int64
+	activeReserve int64
+	readOnly      bool
+	// openedReadOnly is set by OpenReadOnly and never changes afterwards
+	openedReadOnly bool
+
+	watchMu  sync.Mutex
+	watchers map[*Watcher]struct{}
+
+	// cdcMu guards the open CDC readers and the files Merge kept for them
+	cdcMu       sync.Mutex
+	cdcReaders  map[*CDCReader]struct{}
+	mergedFiles map[int64]*mergedFile
+
+	secondaryIndexes map[string]*secondaryIndex
+
 	options Options
 }
 
 type Options struct {
 	DatabaseDirectory string
+	// HistoryRetention is how far back GetAt and History can look once Merge
+	// has run. Zero keeps only the live versions.
+	HistoryRetention time.Duration
+	// WatchBufferSize is how many events a Watcher buffers before it
+	// overflows, defaultWatchBufferSize unless set
+	WatchBufferSize int
+	// FS is where the files live, the operating system's file system unless
+	// set otherwise
+	FS FS
+	// InMemory keeps the files in a MemFS of the database's own, so nothing
+	// touches the disk and everything is gone after Close
+	InMemory bool
+	// Hasher maps keys to keydir slots. A database has to be reopened with
+	// the hasher it was created with.
+	Hasher Hasher
+	// DiskQuota caps the bytes the data and hint files may take. Zero means
+	// no cap besides the disk itself.
+	DiskQuota int64
+	// PreallocateSize is how much disk a new data file reserves up front,
+	// nothing unless set. The reserved space counts toward DiskUsage, and
+	// what is left unused is given back when the file is closed.
+	PreallocateSize int64
+	// DataDirectories spreads new data files over several disks, each
+	// directory getting data and hint subdirectories of its own. The
+	// database directory keeps the metadata, the manifest of which file
+	// lives where, and the files written before.
+	DataDirectories []string
+	// Placement picks the data directory of each new data file
+	Placement Placement
+	// ColdDirectory is where Tier moves data files that have gone cold,
+	// typically on a slower disk
+	ColdDirectory string
+	// ColdAge makes a data file cold once its newest entry is this old.
+	// Zero leaves age out of it.
+	ColdAge time.Duration
+	// HotSizeBudget keeps at most this many bytes of data files besides
+	// the active one out of the cold directory, the newest ones. Zero
+	// means no budget.
+	HotSizeBudget int64
 }
 
 func DefaultOptions(directory string) Options {
 	return Options{
 		DatabaseDirectory: directory,
+		WatchBufferSize:   defaultWatchBufferSize,
+		FS:                OSFS,
+		Hasher:            FNV1a,
 	}
 }
 
 func New(directory string) *FlowDB {
+	return NewWithOptions(DefaultOptions(directory))
+}
+
+// NewWithOptions returns a database tuned by options. Start from
+// DefaultOptions and change the fields needed.
+func NewWithOptions(options Options) *FlowDB {
+	if options.InMemory {
+		options.FS = NewMemFS()
+	}
+	if options.FS == nil {
+		options.FS = OSFS
+	}
+	if options.Hasher == nil {
+		options.Hasher = FNV1a
+	}
+	if options.WatchBufferSize == 0 {
+		options.WatchBufferSize = defaultWatchBufferSize
+	}
 	return &FlowDB{
-		mu:              sync.RWMutex{},
-		activeFile:      nil,
-		indexMap:        make(map[uint64]*KeyDirRecord),
-		fileList:        make(map[int64]*os.File),
-		options:         DefaultOptions(directory),
-		dataFileVersion: 0,
+		mu:               sync.RWMutex{},
+		activeFile:       nil,
+		keydir:           newKeydir(),
+		fileList:         make(map[int64]File),
+		fileVersions:     make(map[int64]uint16),
+		buckets:          newBucketMeta(),
+		manifest:         manifest{Files: make(map[int64]string)},
+		bucketStats:      make(map[uint16]*BucketStats),
+		watchers:         make(map[*Watcher]struct{}),
+		cdcReaders:       make(map[*CDCReader]struct{}),
+		mergedFiles:      make(map[int64]*mergedFile),
+		secondaryIndexes: make(map[string]*secondaryIndex),
+		options:          options,
+		dataFileVersion:  0,
 	}
 }
 
@@ -61,93 +166,421 @@ func (f *FlowDB) Get(key []byte) ([]byte, error) {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
-	sum64 := Hash(key)
-	if f.indexMap[sum64] == nil {
-		return nil, errors.New("key not exist")
+	return f.get(defaultBucket, key)
+}
+
+func (f *FlowDB) Put(key, value []byte) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.put(defaultBucket, key, value)
+}
+
+// Delete removes key. Deleting a missing key is not an error.
+func (f *FlowDB) Delete(key []byte) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.delete(defaultBucket, key)
+}
+
+// Scan calls fn with every string key starting with prefix and its value, in
+// key order, until fn returns false. fn runs without the lock held, so it can
+// write to the database.
+func (f *FlowDB) Scan(prefix []byte, fn func(key, value []byte) bool) error {
+	f.mu.RLock()
+	entries, err := f.scan(defaultBucket, prefix)
+	f.mu.RUnlock()
+	if err != nil {
+		return err
 	}
-	if fd, ok := f.fileList[f.indexMap[sum64].fileId]; ok {
-		data := make([]byte, f.indexMap[sum64].ValueSize)
-		_, err := fd.ReadAt(data, f.indexMap[sum64].ValuePos)
-		if err != nil {
-			return nil, err
+
+	for _, entry := range entries {
+		if !fn(entry.Key, entry.Value) {
+			break
 		}
-		entry := DecodeEntry(data)
-		return entry.Value, nil
 	}
-
-	return []byte{}, errors.New("failed to read")
+	return nil
 }
 
-func (f *FlowDB) Put(key, value []byte) error {
-	f.mu.Lock()
-	defer f.mu.Unlock()
-
-	fileInfo, _ := f.activeFile.Stat()
-	if fileInfo.Size() >= defaultMaxFileSize {
-		err := f.closeActiveFile()
-		if err != nil {
-			return err
+// scan returns the live string entries of bucket whose key starts with
+// prefix, sorted by key. The caller must hold f.mu.
+func (f *FlowDB) scan(bucket uint16, prefix []byte) ([]*Entry, error) {
+	var entries []*Entry
+	for _, record := range f.sortedRecords() {
+		if record.bucket != bucket {
+			continue
 		}
-		err = f.createActiveFile()
+		entry, err := f.readEntry(record)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if entry.Type == TypeString && bytes.HasPrefix(entry.Key, prefix) {
+			entries = append(entries, entry)
 		}
 	}
+	sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].Key, entries[j].Key) < 0 })
+	return entries, nil
+}
 
-	sum64 := Hash(key)
+func (f *FlowDB) get(bucket uint16, key []byte) ([]byte, error) {
+	entry, err := f.lookup(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, ErrKeyNotFound
+	}
+	if entry.Type != TypeString {
+		return nil, ErrWrongType
+	}
+	return entry.Value, nil
+}
+
+func (f *FlowDB) put(bucket uint16, key, value []byte) error {
+	return f.putTyped(bucket, key, value, TypeString)
+}
+
+func (f *FlowDB) putTyped(bucket uint16, key, value []byte, t DataType) error {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	return f.putLocked(bucket, key, value, t)
+}
+
+// putLocked is putTyped for callers that read the key before writing it and
+// hold f.writeMu across both, or f.mu exclusively.
+func (f *FlowDB) putLocked(bucket uint16, key, value []byte, t DataType) error {
 	timestamp := time.Now().UnixMicro()
-	entryData, size := EncodeEntry(&Entry{
+	err := f.writeEntry(&Entry{
 		Timestamp: uint64(timestamp),
+		Bucket:    bucket,
+		Type:      t,
 		Key:       key,
 		Value:     value,
 	})
-	_, err := f.activeFile.Write(entryData)
 	if err != nil {
 		return err
 	}
+	if t == TypeString {
+		f.indexPut(bucket, key, value)
+	} else {
+		f.indexDelete(bucket, key)
+	}
+	f.notify(bucket, Event{
+		Type:      EventPut,
+		DataType:  t,
+		Key:       append([]byte(nil), key...),
+		Value:     append([]byte(nil), value...),
+		Timestamp: timestamp,
+	})
+	return nil
+}
+
+func (f *FlowDB) delete(bucket uint16, key []byte) error {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	return f.deleteLocked(bucket, key)
+}
+
+// deleteLocked is delete for callers holding f.writeMu or f.mu exclusively.
+func (f *FlowDB) deleteLocked(bucket uint16, key []byte) error {
+	entry, err := f.lookup(bucket, key)
+	if err != nil || entry == nil {
+		return err
+	}
+	timestamp := time.Now().UnixMicro()
+	err = f.writeEntry(&Entry{
+		Timestamp: uint64(timestamp),
+		Bucket:    bucket,
+		Flags:     flagTombstone,
+		Key:       key,
+	})
+	if err != nil {
+		return err
+	}
+	f.indexDelete(bucket, key)
+	f.notify(bucket, Event{
+		Type:      EventDelete,
+		Key:       append([]byte(nil), key...),
+		Timestamp: timestamp,
+	})
+	return nil
+}
 
-	// write hint
-	if fd, err := f.openHintFile(f.dataFileVersion); err == nil {
-		data, _ := EncodeHint(&Hint{
-			Timestamp: uint64(timestamp),
-			ValuePos:  uint64(f.activeFileOffset),
-			Key:       sum64,
-		})
-		_, err = fd.Write(data)
-		if err != nil {
-			log.Fatalln(err)
+// lookup returns the live entry of key in bucket, or nil if there is none.
+// The keydir only knows the hash of a key, so an entry of another key that
+// ended up in the same slot is not taken for it.
+func (f *FlowDB) lookup(bucket uint16, key []byte) (*Entry, error) {
+	record := f.keydir.get(f.keyHash(bucket, key))
+	if record == nil {
+		return nil, nil
+	}
+	entry, err := f.readEntry(record)
+	if err != nil {
+		return nil, err
+	}
+	if !entry.is(bucket, key) {
+		return nil, nil
+	}
+	return entry, nil
+}
+
+// readEntry loads the entry a keydir record points at.
+func (f *FlowDB) readEntry(record *KeyDirRecord) (*Entry, error) {
+	fd, version, ok := f.dataFile(record.fileId)
+	if !ok {
+		return nil, ErrCorrupt
+	}
+	data := make([]byte, record.ValueSize)
+	if _, err := fd.ReadAt(data, record.ValuePos); err != nil {
+		return nil, err
+	}
+	entry := decodeEntryVersion(version, data)
+	if entry == nil {
+		return nil, ErrCorrupt
+	}
+	return entry, nil
+}
+
+// writeEntry appends e to the active file, records its hint and points the
+// keydir at it, or drops the key if e is a tombstone. Once the database ran
+// out of space it fails with ErrDiskFull. The caller must hold f.writeMu or
+// f.mu exclusively.
+func (f *FlowDB) writeEntry(e *Entry) error {
+	entryData, size := EncodeEntry(e)
+	if err := f.checkSpace(size); err != nil {
+		return err
+	}
+	return f.appendEntry(e, entryData, size)
+}
+
+// appendEntry does the work of writeEntry without looking at the space left,
+// which Merge needs to free some. The caller must hold f.writeMu or f.mu
+// exclusively.
+func (f *FlowDB) appendEntry(e *Entry, entryData []byte, size uint32) error {
+	if f.activeFileOffset >= defaultMaxFileSize {
+		if err := f.rotateActiveFile(); err != nil {
+			return f.spaceError(err)
 		}
 	}
 
-	f.indexMap[sum64] = &KeyDirRecord{
-		fileId:    f.dataFileVersion,
+	sum64 := f.keyHash(e.Bucket, e.Key)
+	n, err := f.activeFile.Write(entryData)
+	if err != nil {
+		f.rollback(n, 0)
+		return f.spaceError(err)
+	}
+
+	// write hint
+	data, _ := EncodeHint(&Hint{
+		Timestamp: e.Timestamp,
+		ValuePos:  uint64(f.activeFileOffset),
+		Key:       sum64,
 		ValueSize: size,
-		ValuePos:  f.activeFileOffset,
-		Timestamp: timestamp,
+		Bucket:    e.Bucket,
+		Flags:     e.Flags,
+	})
+	hintN, err := f.activeHintFile.Write(data)
+	if err != nil {
+		f.rollback(n, hintN)
+		return f.spaceError(err)
+	}
+
+	if e.Flags&flagTombstone != 0 {
+		f.removeRecord(sum64)
+	} else {
+		f.setRecord(sum64, &KeyDirRecord{
+			fileId:    f.dataFileVersion,
+			bucket:    e.Bucket,
+			ValueSize: size,
+			ValuePos:  f.activeFileOffset,
+			Timestamp: int64(e.Timestamp),
+		})
 	}
+	f.diskUsage += f.dataGrowth(f.activeFileOffset+int64(size)) + int64(len(data))
 	f.activeFileOffset += int64(size)
+	f.activeHintOffset += int64(len(data))
 
 	return nil
 }
 
+// rollback cuts off the n bytes of data and hintN bytes of hint a failed
+// append left behind. Bytes that cannot be cut off stay, and the offsets move
+// past them so later entries are still found where their hints say.
+func (f *FlowDB) rollback(n, hintN int) {
+	if n > 0 && f.activeFile.Truncate(f.activeFileOffset) != nil {
+		f.diskUsage += f.dataGrowth(f.activeFileOffset + int64(n))
+		f.activeFileOffset += int64(n)
+	}
+	if hintN > 0 && f.activeHintFile.Truncate(f.activeHintOffset) != nil {
+		f.activeHintOffset += int64(hintN)
+		f.diskUsage += int64(hintN)
+	}
+}
+
+// setRecord replaces the keydir record of sum64 and keeps the bucket stats
+// in step with it.
+func (f *FlowDB) setRecord(sum64 uint64, record *KeyDirRecord) {
+	if old := f.keydir.set(sum64, record); old != nil {
+		f.stats(old.bucket).remove(old)
+	}
+	f.stats(record.bucket).add(record)
+}
+
+func (f *FlowDB) removeRecord(sum64 uint64) {
+	if old := f.keydir.remove(sum64); old != nil {
+		f.stats(old.bucket).remove(old)
+	}
+}
+
 func (f *FlowDB) Load() error {
-	if ok, err := pathExists(f.options.DatabaseDirectory); ok {
-		return f.recoverData()
-	} else if err != nil {
-		panic(err)
+	if f.options.WatchBufferSize < 0 {
+		return fmt.Errorf("%w: negative watch buffer size", ErrInvalidArgument)
+	}
+	if err := f.options.FS.MkdirAll(path.Join(f.options.DatabaseDirectory, "data"), FM); err != nil {
+		return err
+	}
+	if err := f.options.FS.MkdirAll(path.Join(f.options.DatabaseDirectory, "hint"), FM); err != nil {
+		return err
+	}
+	for _, dir := range append([]string{f.options.ColdDirectory}, f.options.DataDirectories...) {
+		if dir == "" {
+			continue
+		}
+		for _, sub := range []string{"data", "hint"} {
+			if err := f.options.FS.MkdirAll(path.Join(dir, sub), FM); err != nil {
+				return err
+			}
+		}
+	}
+	if err := f.loadManifest(); err != nil {
+		return err
+	}
+	if err := f.finishIngest(); err != nil {
+		return err
+	}
+	if err := f.checkMeta(); err != nil {
+		return err
+	}
+	if err := f.loadBuckets(); err != nil {
+		return err
 	}
 
-	if err := os.MkdirAll(path.Join(f.options.DatabaseDirectory, "data"), FM); err != nil {
-		panic(err)
+	f.version()
+	if f.dataFileVersion == 0 {
+		if err := f.createActiveFile(); err != nil {
+			return err
+		}
+	} else if err := f.recoverData(); err != nil {
+		return err
+	}
+	if err := f.measureDiskUsage(); err != nil {
+		return err
+	}
+	return f.buildSecondaryIndexes()
+}
+
+// OpenReadOnly opens the database in directory, which has to exist, for
+// reading only, the way the offline tools do. It goes by the hasher the
+// directory was written with and changes nothing on disk: no active file is
+// created and a torn tail is left in place, past the end of what is read.
+// Writes fail with ErrReadOnly.
+func OpenReadOnly(directory string) (*FlowDB, error) {
+	f := New(directory)
+	if _, err := f.options.FS.Stat(directory); err != nil {
+		return nil, err
+	}
+	if err := f.useRecordedHasher(); err != nil {
+		return nil, err
+	}
+	if err := f.loadManifest(); err != nil {
+		return nil, err
+	}
+	if err := f.loadBuckets(); err != nil {
+		return nil, err
+	}
+	if _, err := f.options.FS.Stat(path.Join(directory, ingestFileName)); err == nil {
+		return nil, fmt.Errorf("%w: an interrupted ingest is left for Load to finish", ErrReadOnly)
+	}
+	f.openedReadOnly = true
+	if err := f.openReadOnly(); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// openReadOnly opens the data files without write access and builds the
+// keydir, taking the end of the latest file to be where its entries end.
+func (f *FlowDB) openReadOnly() error {
+	for _, id := range f.dataFileIds() {
+		fd, err := f.options.FS.OpenFile(f.dataFilePath(id), os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		version, _, err := readFileHeader(fd, fileKindData)
+		if err != nil {
+			_ = fd.Close()
+			return fmt.Errorf("data file %d: %v", id, err)
+		}
+		f.addDataFile(id, fd, version)
+	}
+
+	f.version()
+	if f.dataFileVersion == 0 {
+		return nil
+	}
+	fd, version, _ := f.dataFile(f.dataFileVersion)
+	info, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	f.activeFileOffset = info.Size()
+	hinted := true
+	if version == formatVersion {
+		if f.activeFileOffset, hinted, err = f.logicalEnd(f.dataFileVersion, info.Size()); err != nil {
+			return err
+		}
+	}
+	if err := f.buildIndex(); err != nil {
+		return err
 	}
-	if err := os.MkdirAll(path.Join(f.options.DatabaseDirectory, "hint"), FM); err != nil {
-		panic(err)
+	if !hinted {
+		// the entries the hints miss are the newest, scanning the file
+		// again in order puts them on top
+		return f.scanDataFile(f.dataFileVersion)
 	}
+	return nil
+}
 
-	return f.createActiveFile()
+// writable fails with ErrReadOnly if the database was opened by
+// OpenReadOnly.
+func (f *FlowDB) writable() error {
+	if f.openedReadOnly {
+		return ErrReadOnly
+	}
+	return nil
 }
 
 func (f *FlowDB) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closeWatchers(ErrClosed)
+	f.closeMergedFiles()
+
+	if f.activeFile != nil {
+		if err := f.activeFile.Truncate(f.activeFileOffset); err != nil {
+			return err
+		}
+	}
+	if f.activeHintFile != nil {
+		if err := f.activeHintFile.Close(); err != nil {
+			return err
+		}
+	}
 	for _, fd := range f.fileList {
 		err := fd.Close()
 		if err != nil {
@@ -158,174 +591,709 @@ func (f *FlowDB) Close() error {
 }
 
 func (f *FlowDB) Sync() error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	if f.openedReadOnly {
+		return nil
+	}
 	err := f.activeFile.Sync()
 	if err != nil {
 		return err
 	}
-	return nil
+	return f.activeHintFile.Sync()
 }
 
+// Merge rewrites the entries worth keeping of every data file into fresh
+// files and removes the old ones, reclaiming the space held by overwritten
+// entries and dropped buckets. Versions still inside the history retention
+// window are kept along with the live ones. Old files open CDC readers have
+// yet to read stay open for them until they have.
 func (f *FlowDB) Merge() error {
-	// todo merge gc
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.writable(); err != nil {
+		return err
+	}
+	if err := f.rotateActiveFile(); err != nil {
+		return f.spaceError(err)
+	}
+
+	var staleFiles []int64
+	for _, id := range f.openFileIds() {
+		if id != f.dataFileVersion {
+			staleFiles = append(staleFiles, id)
+		}
+	}
+
+	keep, err := f.mergeFilter(staleFiles)
+	if err != nil {
+		return err
+	}
+	// copy in file order so versions keep their order on recovery
+	for _, id := range staleFiles {
+		err := f.forEachEntry(id, func(entry *Entry, offset int64) error {
+			if !keep(id, offset, entry) {
+				return nil
+			}
+			data, size := EncodeEntry(entry)
+			return f.appendEntry(entry, data, size)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := f.activeFile.Sync(); err != nil {
+		return err
+	}
+	if err := f.activeHintFile.Sync(); err != nil {
+		return err
+	}
+
+	// CDC readers still reading the old files go on after the copies
+	resume := Position{FileId: f.dataFileVersion, Offset: f.activeFileOffset}
+	// oldest first, so a crash part way never resurrects an overwritten value
+	for i, id := range staleFiles {
+		_, version, _ := f.dataFile(id)
+		fd := f.removeDataFile(id)
+		var next Position
+		if i == len(staleFiles)-1 {
+			next = resume
+		}
+		kept, err := f.keepMergedFile(id, fd, version, next)
+		if err != nil {
+			return err
+		}
+		if !kept {
+			if err := fd.Close(); err != nil {
+				return err
+			}
+		}
+		if err := f.options.FS.Remove(f.dataFilePath(id)); err != nil {
+			return err
+		}
+		if err := f.options.FS.Remove(f.hintFilePath(id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err := f.forgetFiles(staleFiles); err != nil {
+		return err
+	}
+
+	// entries of dropped buckets are gone from disk now
+	f.buckets.Dropped = nil
+	if err := f.saveBuckets(); err != nil {
+		return err
+	}
+	if err := f.measureDiskUsage(); err != nil {
+		return err
+	}
+	f.endReadOnly()
 	return nil
 }
 
+// sortedRecords returns the keydir records in file order, so reading them in
+// turn stays sequential. The caller must hold f.mu.
+func (f *FlowDB) sortedRecords() []*KeyDirRecord {
+	records := make([]*KeyDirRecord, 0, f.keydir.len())
+	f.keydir.each(func(_ uint64, record *KeyDirRecord) {
+		records = append(records, record)
+	})
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].fileId != records[j].fileId {
+			return records[i].fileId < records[j].fileId
+		}
+		return records[i].ValuePos < records[j].ValuePos
+	})
+	return records
+}
+
+// createActiveFile opens the next data file and its hint file for appending,
+// both in the current format. The caller must hold f.writeMu or f.mu
+// exclusively.
 func (f *FlowDB) createActiveFile() error {
-	f.mu.Lock()
-	defer f.mu.Unlock()
+	id := f.dataFileVersion + 1
+	fd, hint, reserved, err := f.openFilePair(id)
+	if err != nil {
+		return err
+	}
+	f.setActiveFile(id, fd, hint, reserved)
+	return nil
+}
 
-	f.dataFileVersion++
-	if fd, err := f.openDataFile(f.dataFileVersion); err == nil {
-		f.activeFile = fd
-		f.fileList[f.dataFileVersion] = fd
-		return nil
+// openFilePair creates data file id and its hint file with their headers,
+// and preallocates the data file if Options.PreallocateSize asks for it,
+// returning how much it reserved. Neither file may exist yet. If that fails
+// the files created are removed again, so a half made pair is never taken
+// for the latest data file. The caller must hold f.writeMu or f.mu
+// exclusively.
+func (f *FlowDB) openFilePair(id int64) (fd, hint File, reserved int64, err error) {
+	if err := f.placeFile(id); err != nil {
+		return nil, nil, 0, err
+	}
+	defer func() {
+		if err != nil {
+			f.discardFilePair(id, fd, hint)
+			fd, hint = nil, nil
+		}
+	}()
+	if fd, err = f.options.FS.OpenFile(f.dataFilePath(id), FFlag|os.O_EXCL, FM); err != nil {
+		return nil, nil, 0, fmt.Errorf("failed to create active file: %w", err)
+	}
+	if hint, err = f.options.FS.OpenFile(f.hintFilePath(id), FFlag|os.O_EXCL, FM); err != nil {
+		return fd, nil, 0, fmt.Errorf("failed to create active file: %w", err)
+	}
+	if err = writeFileHeader(fd, fileKindData); err != nil {
+		return fd, hint, 0, err
+	}
+	if err = writeFileHeader(hint, fileKindHint); err != nil {
+		return fd, hint, 0, err
 	}
+	if f.options.PreallocateSize > 0 {
+		if reserved, err = preallocate(fd, f.options.PreallocateSize); err != nil {
+			return fd, hint, 0, err
+		}
+	}
+	return fd, hint, reserved, nil
+}
 
-	return errors.New("failed to create active file")
+// discardFilePair closes and removes the files of a pair made by
+// openFilePair that did not become the active file. Either may be nil.
+func (f *FlowDB) discardFilePair(id int64, fd, hint File) {
+	if fd != nil {
+		_ = fd.Close()
+		_ = f.options.FS.Remove(f.dataFilePath(id))
+	}
+	if hint != nil {
+		_ = hint.Close()
+		_ = f.options.FS.Remove(f.hintFilePath(id))
+	}
 }
 
-func (f *FlowDB) closeActiveFile() error {
-	f.mu.Lock()
-	defer f.mu.Unlock()
+// setActiveFile makes the pair opened by openFilePair the active file. The
+// caller must hold f.writeMu or f.mu exclusively.
+func (f *FlowDB) setActiveFile(id int64, fd, hint File, reserved int64) {
+	f.dataFileVersion = id
+	f.activeFile = fd
+	f.activeHintFile = hint
+	f.activeFileOffset = fileHeaderSize
+	f.activeHintOffset = fileHeaderSize
+	f.activeReserve = reserved
+	data := int64(fileHeaderSize)
+	if reserved > data {
+		data = reserved
+	}
+	f.diskUsage += data + fileHeaderSize
+	f.addDataFile(id, fd, formatVersion)
+}
 
+// writeFileHeader starts an empty file with the header of the current format.
+func writeFileHeader(fd File, kind uint8) error {
+	info, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > 0 {
+		return errors.New("file already exist")
+	}
+	_, err = fd.Write(encodeFileHeader(kind, formatVersion))
+	return err
+}
+
+// closeActiveFile flushes the active file, gives back the space it reserved
+// and closes its hint file. The data file stays open in fileList for readers
+// that may still be using it. The caller must hold f.writeMu or f.mu
+// exclusively.
+func (f *FlowDB) closeActiveFile() error {
 	err := f.activeFile.Sync()
 	if err != nil {
 		return err
 	}
-	err = f.activeFile.Close()
+	err = f.activeFile.Truncate(f.activeFileOffset)
 	if err != nil {
 		return err
 	}
-	df := path.Join(f.options.DatabaseDirectory, "data", fmt.Sprintf("%d.data", f.dataFileVersion))
-	if fd, err := os.OpenFile(df, os.O_RDONLY, FM); err == nil {
-		f.fileList[f.dataFileVersion] = fd
+	f.diskUsage -= f.reservation()
+	f.activeReserve = 0
+	err = f.activeHintFile.Sync()
+	if err != nil {
+		return err
 	}
+	return f.activeHintFile.Close()
+}
 
-	return errors.New("error close active file")
+// rotateActiveFile moves writes on to the next data file. The new pair is
+// made before the active one is closed, so if either step fails the active
+// file stays as it was and writes can go on once there is room. The caller
+// must hold f.writeMu or f.mu exclusively.
+func (f *FlowDB) rotateActiveFile() error {
+	id := f.dataFileVersion + 1
+	fd, hint, reserved, err := f.openFilePair(id)
+	if err != nil {
+		return err
+	}
+	if err := f.closeActiveFile(); err != nil {
+		f.discardFilePair(id, fd, hint)
+		return err
+	}
+	f.setActiveFile(id, fd, hint, reserved)
+	return nil
 }
 
 func (f *FlowDB) recoverData() error {
-	f.version()
-	if fd, err := f.openDataFile(f.dataFileVersion); err == nil {
-		fileInfo, _ := fd.Stat()
-		if fileInfo.Size() >= defaultMaxFileSize {
-			if err := f.createActiveFile(); err != nil {
+	for _, id := range f.dataFileIds() {
+		fd, err := f.openDataFile(id)
+		if err != nil {
+			return errors.New("failed to recover data")
+		}
+		version, _, err := readFileHeader(fd, fileKindData)
+		if err != nil {
+			_ = fd.Close()
+			return fmt.Errorf("data file %d: %v", id, err)
+		}
+		f.addDataFile(id, fd, version)
+	}
+
+	fd, version, _ := f.dataFile(f.dataFileVersion)
+	size, err := fd.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	offset := size
+	// fileEnd of the latest file while its hints are rebuilt or scanned
+	f.activeFileOffset = offset
+	if version == formatVersion {
+		var hinted bool
+		if offset, hinted, err = f.logicalEnd(f.dataFileVersion, size); err != nil {
+			return err
+		}
+		if offset < size {
+			if err := fd.Truncate(offset); err != nil {
 				return err
 			}
-			return f.buildIndex()
 		}
-		f.activeFile = fd
-		if offset, err := fd.Seek(0, io.SeekEnd); err == nil {
-			f.activeFileOffset = offset
+		f.activeFileOffset = offset
+		if !hinted {
+			if err := f.rewriteHintFile(f.dataFileVersion); err != nil {
+				return err
+			}
 		}
-		return f.buildIndex()
 	}
-
-	return errors.New("failed to recover data")
-}
-
-func (f *FlowDB) buildIndex() error {
-	if err := f.readHintFile(); err != nil {
+	if err := f.buildIndex(); err != nil {
+		return err
+	}
+	// older formats are read but never appended to
+	if offset >= defaultMaxFileSize || version != formatVersion {
+		return f.createActiveFile()
+	}
+	hint, err := f.openHintFile(f.dataFileVersion)
+	if err != nil {
+		return errors.New("failed to recover data")
+	}
+	hintOffset, err := hint.Seek(0, io.SeekEnd)
+	if err != nil {
+		_ = hint.Close()
 		return err
 	}
+	// cut off a torn record so the next one is not written out of step
+	if torn := (hintOffset - fileHeaderSize) % int64(hintHeaderSize); hintOffset > fileHeaderSize && torn != 0 {
+		hintOffset -= torn
+		if err := hint.Truncate(hintOffset); err != nil {
+			_ = hint.Close()
+			return err
+		}
+	}
+	f.activeFile = fd
+	f.activeHintFile = hint
+	f.activeFileOffset = offset
+	f.activeHintOffset = hintOffset
+	if f.options.PreallocateSize > 0 {
+		// a full disk still opens, for reads and a Merge to free space
+		reserved, err := preallocate(fd, f.options.PreallocateSize)
+		if err != nil && f.spaceError(err) != ErrDiskFull {
+			return err
+		}
+		f.activeReserve = reserved
+	}
+	return nil
+}
 
-	for _, record := range f.indexMap {
-		if f.fileList[record.fileId] == nil {
-			fd, err := f.openDataFile(record.fileId)
-			if err != nil {
-				return err
+// logicalEnd returns where the entries of data file id end, which can be
+// short of its size after a crash left a torn entry or reserved space behind
+// them, and whether its hint file covers all of them. Hints are not synced
+// with the data, so the entries past the last one the hints know of, or all
+// of them when the hint file is missing or damaged, are walked until one does
+// not pass its CRC check.
+func (f *FlowDB) logicalEnd(id int64, size int64) (int64, bool, error) {
+	end, hinted := f.dataStart(id), false
+	_, err := f.options.FS.Stat(f.hintFilePath(id))
+	if err == nil {
+		err = f.forEachHint(id, func(hint *Hint) error {
+			if e := int64(hint.ValuePos) + int64(hint.ValueSize); e > end {
+				end = e
 			}
-			f.fileList[record.fileId] = fd
+			return nil
+		})
+		hinted = err == nil && end <= size
+		if err == errCorruptHint {
+			err = nil
 		}
 	}
+	if err != nil && !os.IsNotExist(err) {
+		return 0, false, err
+	}
+	if !hinted {
+		end = f.dataStart(id)
+	}
 
-	return nil
+	fd, version, _ := f.dataFile(id)
+	header := make([]byte, entryHeaderSize)
+	walked := end
+	for walked < size {
+		entry, n, _, err := readEntryAt(fd, version, walked, size, header)
+		if err != nil {
+			return 0, false, err
+		}
+		if entry == nil {
+			break
+		}
+		walked += n
+	}
+	return walked, hinted && walked == end, nil
 }
 
+// rewriteHintFile replaces the hint file of data file id with one made from
+// its entries, written aside and renamed over the old one. The caller must
+// hold f.writeMu or f.mu exclusively.
+func (f *FlowDB) rewriteHintFile(id int64) error {
+	file := f.hintFilePath(id)
+	fd, err := f.options.FS.OpenFile(file+".tmp", FFlag|os.O_TRUNC, FM)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	if err := writeFileHeader(fd, fileKindHint); err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fd)
+	err = f.forEachEntry(id, func(entry *Entry, offset int64) error {
+		data, _ := EncodeHint(&Hint{
+			Timestamp: entry.Timestamp,
+			ValuePos:  uint64(offset),
+			Key:       f.keyHash(entry.Bucket, entry.Key),
+			ValueSize: entryHeaderSize + uint32(len(entry.Key)) + uint32(len(entry.Value)),
+			Bucket:    entry.Bucket,
+			Flags:     entry.Flags,
+		})
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := fd.Sync(); err != nil {
+		return err
+	}
+	return f.options.FS.Rename(file+".tmp", file)
+}
+
+func (f *FlowDB) buildIndex() error {
+	return f.readHintFile()
+}
+
+// readHintFile builds the keydir from the hint files. A data file without a
+// hint file, or whose hint file holds a record that fails its CRC check, is
+// scanned instead.
 func (f *FlowDB) readHintFile() error {
-	fid := f.findLatestHintFile()
-	for i := int64(1); i <= fid; i++ {
-		if fd, err := f.openHintFile(i); err == nil {
-			buf := make([]byte, hintHeaderSize)
-			for {
-				_, err := fd.Read(buf)
-				if err != nil && err != io.EOF {
+	for _, id := range f.openFileIds() {
+		if _, err := f.options.FS.Stat(f.hintFilePath(id)); os.IsNotExist(err) {
+			if err := f.scanDataFile(id); err != nil {
+				return err
+			}
+			continue
+		}
+		_, version, _ := f.dataFile(id)
+		err := f.forEachHint(id, func(hint *Hint) error {
+			if version < formatV4 && hint.Bucket != defaultBucket {
+				if err := f.rehashHint(id, hint); err != nil {
 					return err
 				}
-				if err == io.EOF {
-					break
-				}
-				hint := DecodeHint(buf)
-				f.indexMap[hint.Key] = &KeyDirRecord{
-					fileId:    i,
-					ValueSize: 0, // todo
-					ValuePos:  int64(hint.ValuePos),
-					Timestamp: int64(hint.Timestamp),
-				}
-			}
-			err = fd.Close()
-			if err != nil {
-				return err
 			}
+			return f.indexHint(id, hint)
+		})
+		if err == errCorruptHint {
+			err = f.scanDataFile(id)
+		}
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func (f *FlowDB) version() {
-	f.dataFileVersion = f.findLatestDataFile()
+// scanDataFile indexes every entry of a data file, as its hint file would.
+// The caller must hold f.mu.
+func (f *FlowDB) scanDataFile(fileId int64) error {
+	return f.forEachEntry(fileId, func(entry *Entry, offset int64) error {
+		return f.indexHint(fileId, &Hint{
+			Timestamp: entry.Timestamp,
+			ValuePos:  uint64(offset),
+			Key:       f.keyHash(entry.Bucket, entry.Key),
+			ValueSize: entryHeaderSize + uint32(len(entry.Key)) + uint32(len(entry.Value)),
+			Bucket:    entry.Bucket,
+			Flags:     entry.Flags,
+		})
+	})
 }
 
-func (f *FlowDB) findLatestHintFile() int64 {
-	files, _ := ioutil.ReadDir(path.Join(f.options.DatabaseDirectory, "hint"))
+// rehashHint moves a hint written before v4 for a key outside the default
+// bucket to the slot the key hashes to now, reading the key from the entry.
+func (f *FlowDB) rehashHint(fileId int64, hint *Hint) error {
+	size := hint.ValueSize
+	if size == 0 {
+		var err error
+		if size, _, err = f.entryHeader(fileId, int64(hint.ValuePos)); err != nil {
+			return err
+		}
+	}
+	entry, err := f.readEntry(&KeyDirRecord{fileId: fileId, ValueSize: size, ValuePos: int64(hint.ValuePos)})
+	if err != nil {
+		return err
+	}
+	hint.Key = f.keyHash(entry.Bucket, entry.Key)
+	return nil
+}
 
-	var datafiles []fs.FileInfo
-	for _, file := range files {
-		if path.Ext(file.Name()) == ".hint" {
-			datafiles = append(datafiles, file)
+// indexHint applies a hint of data file fileId to the keydir. The caller
+// must hold f.mu.
+func (f *FlowDB) indexHint(fileId int64, hint *Hint) error {
+	if f.buckets.isDropped(hint.Bucket) {
+		return nil
+	}
+	size, flags := hint.ValueSize, hint.Flags
+	if size == 0 {
+		var err error
+		if size, flags, err = f.entryHeader(fileId, int64(hint.ValuePos)); err != nil {
+			return err
 		}
 	}
-	var ids []int
-	for _, info := range datafiles {
-		id := strings.Split(info.Name(), ".")[0]
-		i, _ := strconv.Atoi(id)
-		ids = append(ids, i)
+	if flags&flagTombstone != 0 {
+		f.removeRecord(hint.Key)
+		return nil
 	}
-	sort.Ints(ids)
+	f.setRecord(hint.Key, &KeyDirRecord{
+		fileId:    fileId,
+		bucket:    hint.Bucket,
+		ValueSize: size,
+		ValuePos:  int64(hint.ValuePos),
+		Timestamp: int64(hint.Timestamp),
+	})
+	return nil
+}
 
-	if len(ids) == 0 {
-		return 1
+// forEachHint calls fn with every hint of a hint file in order. A missing
+// hint file has no hints, and a torn last record is ignored. A record failing
+// its CRC check stops the walk with errCorruptHint.
+func (f *FlowDB) forEachHint(fileId int64, fn func(*Hint) error) error {
+	fd, err := f.options.FS.OpenFile(f.hintFilePath(fileId), os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return nil
 	}
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
 
-	return int64(ids[len(ids)-1])
+	version, start, err := readFileHeader(fd, fileKindHint)
+	if err != nil {
+		return fmt.Errorf("hint file %d: %v", fileId, err)
+	}
+	decode, size := DecodeHint, hintHeaderSize
+	switch version {
+	case formatV1:
+		decode, size = decodeHintV1, hintHeaderSizeV1
+	case formatV2:
+		decode, size = decodeHintV2, hintHeaderSizeV2
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(fd, start, math.MaxInt64))
+	buf := make([]byte, size)
+	for {
+		_, err := io.ReadFull(r, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		hint := decode(buf)
+		if hint == nil {
+			return errCorruptHint
+		}
+		if err := fn(hint); err != nil {
+			return err
+		}
+	}
+}
+
+// forEachEntry calls fn with every entry of a data file in order, along with
+// its offset. The caller must hold f.writeMu or f.mu exclusively.
+func (f *FlowDB) forEachEntry(fileId int64, fn func(*Entry, int64) error) error {
+	end, err := f.fileEnd(fileId)
+	if err != nil {
+		return err
+	}
+	fd, version, _ := f.dataFile(fileId)
+	start := f.dataStart(fileId)
+	r := bufio.NewReader(io.NewSectionReader(fd, start, end-start))
+	header := make([]byte, entryHeaderSize)
+	for offset := start; offset < end; {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return err
+		}
+		keySize, valueSize, _ := decodeEntryHeaderVersion(version, header)
+		data := make([]byte, entryHeaderSize+keySize+valueSize)
+		copy(data, header)
+		if _, err := io.ReadFull(r, data[entryHeaderSize:]); err != nil {
+			return err
+		}
+		entry := decodeEntryVersion(version, data)
+		if entry == nil {
+			return ErrCorrupt
+		}
+		if err := fn(entry, offset); err != nil {
+			return err
+		}
+		offset += int64(len(data))
+	}
+	return nil
+}
+
+// entryHeader reads the header of the entry at pos to find its encoded size
+// and flags.
+func (f *FlowDB) entryHeader(fileId, pos int64) (uint32, uint8, error) {
+	fd, version, ok := f.dataFile(fileId)
+	if !ok {
+		return 0, 0, ErrCorrupt
+	}
+	header := make([]byte, entryHeaderSize)
+	if _, err := fd.ReadAt(header, pos); err != nil {
+		return 0, 0, err
+	}
+	keySize, valueSize, flags := decodeEntryHeaderVersion(version, header)
+	return entryHeaderSize + keySize + valueSize, flags, nil
+}
+
+// dataStart returns the offset of the first entry of a data file.
+func (f *FlowDB) dataStart(fileId int64) int64 {
+	if _, version, _ := f.dataFile(fileId); version == formatV1 {
+		return 0
+	}
+	return fileHeaderSize
+}
+
+// dataFile returns the open data file id and its format version.
+func (f *FlowDB) dataFile(id int64) (File, uint16, bool) {
+	f.filesMu.RLock()
+	defer f.filesMu.RUnlock()
+
+	fd, ok := f.fileList[id]
+	return fd, f.fileVersions[id], ok
+}
+
+func (f *FlowDB) addDataFile(id int64, fd File, version uint16) {
+	f.filesMu.Lock()
+	defer f.filesMu.Unlock()
+
+	f.fileList[id] = fd
+	f.fileVersions[id] = version
+}
+
+// removeDataFile forgets data file id and returns it for closing.
+func (f *FlowDB) removeDataFile(id int64) File {
+	f.filesMu.Lock()
+	defer f.filesMu.Unlock()
+
+	fd := f.fileList[id]
+	delete(f.fileList, id)
+	delete(f.fileVersions, id)
+	return fd
+}
+
+// openFileIds returns the ids of the open data files in order.
+func (f *FlowDB) openFileIds() []int64 {
+	f.filesMu.RLock()
+	defer f.filesMu.RUnlock()
+
+	ids := make([]int64, 0, len(f.fileList))
+	for id := range f.fileList {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (f *FlowDB) version() {
+	f.dataFileVersion = f.findLatestDataFile()
 }
 
 func (f *FlowDB) findLatestDataFile() int64 {
-	files, _ := ioutil.ReadDir(path.Join(f.options.DatabaseDirectory, "data"))
+	ids := f.dataFileIds()
+	if len(ids) == 0 {
+		return 0
+	}
+	return ids[len(ids)-1]
+}
+
+func (f *FlowDB) dataFileIds() []int64 {
+	return f.fileIds("data")
+}
 
-	var datafiles []fs.FileInfo
+func (f *FlowDB) hintFileIds() []int64 {
+	return f.fileIds("hint")
+}
+
+// listFileIds returns the sorted numeric ids of the files with extension ext
+// in dir.
+func listFileIds(fs FS, dir, ext string) []int64 {
+	files, _ := fs.ReadDir(dir)
+
+	var ids []int64
 	for _, file := range files {
-		if path.Ext(file.Name()) == ".data" {
-			datafiles = append(datafiles, file)
+		if path.Ext(file.Name()) != ext {
+			continue
+		}
+		id := strings.Split(file.Name(), ".")[0]
+		i, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			continue
 		}
-	}
-	var ids []int
-	for _, info := range datafiles {
-		id := strings.Split(info.Name(), ".")[0]
-		i, _ := strconv.Atoi(id)
 		ids = append(ids, i)
 	}
-	sort.Ints(ids)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids
+}
+
+func (f *FlowDB) dataFilePath(dataFileVersion int64) string {
+	return path.Join(f.fileDir(dataFileVersion), "data", fmt.Sprintf("%d.data", dataFileVersion))
+}
 
-	return int64(ids[len(ids)-1])
+func (f *FlowDB) hintFilePath(hintFileVersion int64) string {
+	return path.Join(f.fileDir(hintFileVersion), "hint", fmt.Sprintf("%d.hint", hintFileVersion))
 }
 
-func (f *FlowDB) openDataFile(dataFileVersion int64) (*os.File, error) {
-	df := path.Join(f.options.DatabaseDirectory, "data", fmt.Sprintf("%d.data", dataFileVersion))
-	return os.OpenFile(df, FFlag, FM)
+func (f *FlowDB) openDataFile(dataFileVersion int64) (File, error) {
+	return f.options.FS.OpenFile(f.dataFilePath(dataFileVersion), FFlag, FM)
 }
 
-func (f *FlowDB) openHintFile(hintFileVersion int64) (*os.File, error) {
-	df := path.Join(f.options.DatabaseDirectory, "hint", fmt.Sprintf("%d.hint", hintFileVersion))
-	return os.OpenFile(df, FFlag, FM)
+func (f *FlowDB) openHintFile(hintFileVersion int64) (File, error) {
+	return f.options.FS.OpenFile(f.hintFilePath(hintFileVersion), FFlag, FM)
 }
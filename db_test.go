@@ -1,8 +1,13 @@
 package flowdb
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path"
 	"strconv"
+	"sync"
 	"testing"
 )
 
@@ -36,3 +41,187 @@ func TestFlowDB(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestDelete(t *testing.T) {
+	dir := t.TempDir()
+	db := New(dir)
+	require.NoError(t, db.Load())
+	require.NoError(t, db.Put([]byte("a"), []byte("1")))
+	require.NoError(t, db.Put([]byte("b"), []byte("2")))
+	require.NoError(t, db.Delete([]byte("a")))
+	require.NoError(t, db.Delete([]byte("missing")))
+	_, err := db.Get([]byte("a"))
+	require.Error(t, err)
+	require.NoError(t, db.Close())
+
+	// the tombstone survives a restart
+	db = New(dir)
+	require.NoError(t, db.Load())
+	_, err = db.Get([]byte("a"))
+	require.Error(t, err)
+	value, err := db.Get([]byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), value)
+	require.NoError(t, db.Close())
+}
+
+func TestCorruptHintFallsBackToData(t *testing.T) {
+	dir := t.TempDir()
+	db := New(dir)
+	require.NoError(t, db.Load())
+	require.NoError(t, db.Put([]byte("a"), []byte("1")))
+	require.NoError(t, db.Put([]byte("b"), []byte("2")))
+	require.NoError(t, db.Delete([]byte("a")))
+	require.NoError(t, db.Close())
+
+	file := path.Join(dir, "hint", "1.hint")
+	data, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	data[fileHeaderSize+hintHeaderSize+10] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(file, data, FM))
+
+	db = New(dir)
+	require.NoError(t, db.Load())
+	_, err = db.Get([]byte("a"))
+	require.Error(t, err)
+	value, err := db.Get([]byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), value)
+	versions, err := db.History([]byte("a"))
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	require.NoError(t, db.Close())
+}
+
+func TestScan(t *testing.T) {
+	db := New(t.TempDir())
+	require.NoError(t, db.Load())
+	require.NoError(t, db.Put([]byte("user:2"), []byte("bob")))
+	require.NoError(t, db.Put([]byte("user:1"), []byte("alice")))
+	require.NoError(t, db.Put([]byte("user:3"), []byte("carol")))
+	require.NoError(t, db.Put([]byte("order:1"), []byte("book")))
+	require.NoError(t, db.Delete([]byte("user:3")))
+	_, err := db.RPush([]byte("user:list"), []byte("a"))
+	require.NoError(t, err)
+
+	var keys, values []string
+	require.NoError(t, db.Scan([]byte("user:"), func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		values = append(values, string(value))
+		return true
+	}))
+	require.Equal(t, []string{"user:1", "user:2"}, keys)
+	require.Equal(t, []string{"alice", "bob"}, values)
+
+	count := 0
+	require.NoError(t, db.Scan(nil, func(key, value []byte) bool {
+		count++
+		return false
+	}))
+	require.Equal(t, 1, count)
+	require.NoError(t, db.Close())
+}
+
+func TestInMemory(t *testing.T) {
+	dir := path.Join(t.TempDir(), "db")
+	options := DefaultOptions(dir)
+	options.InMemory = true
+	db := NewWithOptions(options)
+	require.NoError(t, db.Load())
+	for i := 0; i < 10; i++ {
+		require.NoError(t, db.Put([]byte("k:"+strconv.Itoa(i)), []byte(strconv.Itoa(i))))
+	}
+	require.NoError(t, db.Delete([]byte("k:0")))
+	require.NoError(t, db.Merge())
+
+	value, err := db.Get([]byte("k:9"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("9"), value)
+	_, err = db.Get([]byte("k:0"))
+	require.Error(t, err)
+	count := 0
+	require.NoError(t, db.Scan([]byte("k:"), func(key, value []byte) bool {
+		count++
+		return true
+	}))
+	require.Equal(t, 9, count)
+	require.NoError(t, db.Close())
+
+	_, err = os.Stat(dir)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	db := New(path.Join(t.TempDir(), "db"))
+	require.NoError(t, db.Load())
+	defer db.Close()
+
+	// the goroutines report back instead of failing the test themselves
+	errs := make(chan error, 7)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := []byte("k:" + strconv.Itoa(w) + ":" + strconv.Itoa(i))
+				if err := db.Put(key, []byte(strconv.Itoa(i))); err != nil {
+					errs <- err
+					return
+				}
+				value, err := db.Get(key)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if string(value) != strconv.Itoa(i) {
+					errs <- fmt.Errorf("%s holds %s", key, value)
+					return
+				}
+				if i%10 == 0 {
+					if err := db.Delete(key); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	for w := 0; w < 2; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if _, err := db.Incr([]byte("counter")); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			if err := db.Merge(); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	value, err := db.Get([]byte("counter"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("200"), value)
+	count := 0
+	require.NoError(t, db.Scan([]byte("k:"), func(key, value []byte) bool {
+		count++
+		return true
+	}))
+	require.Equal(t, 4*180, count)
+}
@@ -0,0 +1,224 @@
+package flowdb
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Formats Export writes and Import reads
+const (
+	FormatJSONLines = "jsonl"
+	FormatCSV       = "csv"
+)
+
+// defaultImportBatch is how many records Import writes per lock and sync
+const defaultImportBatch = 1000
+
+var csvHeader = []string{"bucket", "type", "key", "value", "base64"}
+
+var typeNames = map[DataType]string{
+	TypeString: "string",
+	TypeList:   "list",
+	TypeHash:   "hash",
+	TypeSet:    "set",
+	TypeZSet:   "zset",
+}
+
+// Record is one live key as Export writes it. Lists, hashes, sets and sorted
+// sets carry their encoded value, so they always come out in base64; Key and
+// Value are base64 whenever either of them is not valid UTF-8.
+type Record struct {
+	Bucket string `json:"bucket,omitempty"`
+	Type   string `json:"type,omitempty"`
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Base64 bool   `json:"base64,omitempty"`
+}
+
+// Export writes every live key of every bucket to w, one record per line in
+// the given format, and returns how many it wrote.
+func (f *FlowDB) Export(w io.Writer, format string) (int, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	var write func(*Record) error
+	var flush func() error
+	switch format {
+	case FormatJSONLines:
+		bw := bufio.NewWriter(w)
+		enc := json.NewEncoder(bw)
+		write = func(r *Record) error { return enc.Encode(r) }
+		flush = bw.Flush
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(csvHeader); err != nil {
+			return 0, err
+		}
+		write = func(r *Record) error {
+			return cw.Write([]string{r.Bucket, r.Type, r.Key, r.Value, strconv.FormatBool(r.Base64)})
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	default:
+		return 0, fmt.Errorf("unknown format %q", format)
+	}
+
+	names := make(map[uint16]string, len(f.buckets.Buckets))
+	for name, id := range f.buckets.Buckets {
+		names[id] = name
+	}
+	count := 0
+	for _, record := range f.sortedRecords() {
+		if record.bucket == raftBucket {
+			continue
+		}
+		entry, err := f.readEntry(record)
+		if err != nil {
+			return count, err
+		}
+		if err := write(newRecord(names[entry.Bucket], entry)); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, flush()
+}
+
+func newRecord(bucket string, entry *Entry) *Record {
+	r := &Record{Bucket: bucket, Key: string(entry.Key), Value: string(entry.Value)}
+	if entry.Type != TypeString {
+		r.Type = typeNames[entry.Type]
+	}
+	if entry.Type != TypeString || !utf8.Valid(entry.Key) || !utf8.Valid(entry.Value) {
+		r.Key = base64.StdEncoding.EncodeToString(entry.Key)
+		r.Value = base64.StdEncoding.EncodeToString(entry.Value)
+		r.Base64 = true
+	}
+	return r
+}
+
+// Import reads records written by Export from r and stores them, creating
+// missing buckets. Records are written batch at a time, each batch under one
+// lock and followed by a sync; batch 0 picks a default size. It returns how
+// many records were stored.
+func (f *FlowDB) Import(r io.Reader, format string, batch int) (int, error) {
+	if batch <= 0 {
+		batch = defaultImportBatch
+	}
+
+	var read func() (*Record, error)
+	switch format {
+	case FormatJSONLines:
+		dec := json.NewDecoder(r)
+		read = func() (*Record, error) {
+			var record Record
+			if err := dec.Decode(&record); err != nil {
+				return nil, err
+			}
+			return &record, nil
+		}
+	case FormatCSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = len(csvHeader)
+		if _, err := cr.Read(); err != nil {
+			return 0, err
+		}
+		read = func() (*Record, error) {
+			fields, err := cr.Read()
+			if err != nil {
+				return nil, err
+			}
+			encoded, err := strconv.ParseBool(fields[4])
+			if err != nil {
+				return nil, err
+			}
+			return &Record{Bucket: fields[0], Type: fields[1], Key: fields[2], Value: fields[3], Base64: encoded}, nil
+		}
+	default:
+		return 0, fmt.Errorf("unknown format %q", format)
+	}
+
+	count := 0
+	for {
+		var records []*Record
+		for len(records) < batch {
+			record, err := read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return count, fmt.Errorf("record %d: %v", count+len(records)+1, err)
+			}
+			records = append(records, record)
+		}
+		if len(records) == 0 {
+			return count, nil
+		}
+		if err := f.importBatch(records); err != nil {
+			return count, err
+		}
+		count += len(records)
+	}
+}
+
+// importBatch stores records under one lock and syncs them.
+func (f *FlowDB) importBatch(records []*Record) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.writable(); err != nil {
+		return err
+	}
+	for _, r := range records {
+		key, value := []byte(r.Key), []byte(r.Value)
+		if r.Base64 {
+			var err error
+			if key, err = base64.StdEncoding.DecodeString(r.Key); err != nil {
+				return err
+			}
+			if value, err = base64.StdEncoding.DecodeString(r.Value); err != nil {
+				return err
+			}
+		}
+		if len(key) == 0 {
+			return errEmptyKey
+		}
+
+		t, ok := TypeString, r.Type == ""
+		for dataType, name := range typeNames {
+			if name == r.Type {
+				t, ok = dataType, true
+			}
+		}
+		if !ok {
+			return fmt.Errorf("unknown type %q", r.Type)
+		}
+
+		bucket := defaultBucket
+		if r.Bucket != "" {
+			id, exists := f.buckets.Buckets[r.Bucket]
+			if !exists {
+				var err error
+				if id, err = f.createBucket(r.Bucket); err != nil {
+					return err
+				}
+			}
+			bucket = id
+		}
+		if err := f.putTyped(bucket, key, value, t); err != nil {
+			return err
+		}
+	}
+	if err := f.activeFile.Sync(); err != nil {
+		return err
+	}
+	return f.activeHintFile.Sync()
+}
@@ -0,0 +1,98 @@
+package flowdb
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	db := New(t.TempDir())
+	require.NoError(t, db.Load())
+	require.NoError(t, db.Put([]byte("a"), []byte("1")))
+	require.NoError(t, db.Put([]byte("bin"), []byte{0xff, 0x00, 0xfe}))
+	_, err := db.RPush([]byte("queue"), []byte("x"), []byte("y"))
+	require.NoError(t, err)
+	users, err := db.CreateBucket("users")
+	require.NoError(t, err)
+	require.NoError(t, users.Put([]byte("alice"), []byte("admin")))
+
+	for _, format := range []string{FormatJSONLines, FormatCSV} {
+		var buf bytes.Buffer
+		count, err := db.Export(&buf, format)
+		require.NoError(t, err)
+		require.Equal(t, 4, count)
+
+		copied := New(t.TempDir())
+		require.NoError(t, copied.Load())
+		count, err = copied.Import(&buf, format, 3)
+		require.NoError(t, err)
+		require.Equal(t, 4, count)
+
+		value, err := copied.Get([]byte("bin"))
+		require.NoError(t, err)
+		require.Equal(t, []byte{0xff, 0x00, 0xfe}, value)
+		items, err := copied.LRange([]byte("queue"), 0, -1)
+		require.NoError(t, err)
+		require.Equal(t, [][]byte{[]byte("x"), []byte("y")}, items)
+		value, err = copied.Bucket("users").Get([]byte("alice"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("admin"), value)
+		require.NoError(t, copied.Close())
+	}
+
+	var buf bytes.Buffer
+	_, err = db.Export(&buf, FormatJSONLines)
+	require.NoError(t, err)
+	require.Contains(t, buf.String(), `{"key":"a","value":"1"}`)
+	require.NoError(t, db.Close())
+
+	db = New(t.TempDir())
+	require.NoError(t, db.Load())
+	_, err = db.Import(strings.NewReader(`{"key":"a","value":"1","type":"tree"}`), FormatJSONLines, 0)
+	require.Error(t, err)
+	require.NoError(t, db.Close())
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	_, err := OpenReadOnly(path.Join(dir, "missing"))
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path.Join(dir, "missing"))
+	require.True(t, os.IsNotExist(err))
+
+	db := New(dir)
+	require.NoError(t, db.Load())
+	require.NoError(t, db.Put([]byte("a"), []byte("1")))
+	require.NoError(t, db.Close())
+	// a torn entry is left where it is
+	file := path.Join(dir, "data", "1.data")
+	fd, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, FM)
+	require.NoError(t, err)
+	_, err = fd.Write([]byte{1, 2, 3})
+	require.NoError(t, err)
+	require.NoError(t, fd.Close())
+	before, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+
+	db, err = OpenReadOnly(dir)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	count, err := db.Export(&buf, FormatJSONLines)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+	require.Equal(t, ErrReadOnly, db.Put([]byte("b"), []byte("2")))
+	require.Equal(t, ErrReadOnly, db.Merge())
+	_, err = db.CreateBucket("users")
+	require.Equal(t, ErrReadOnly, err)
+	require.NoError(t, db.Close())
+
+	after, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+	require.Equal(t, []int64{1}, listFileIds(OSFS, path.Join(dir, "data"), ".data"))
+}
@@ -1,6 +1,7 @@
 package flowdb
 
 import (
+	"bytes"
 	"encoding/binary"
 	"hash/crc32"
 )
@@ -8,14 +9,21 @@ import (
 type Entry struct {
 	CRC       uint32
 	Timestamp uint64
+	Bucket    uint16
+	Flags     uint8
+	Type      DataType
 	KeySize   uint32
 	ValueSize uint32
 	Key       []byte
 	Value     []byte
 }
 
+// both layouts have a 24 byte header
 const entryHeaderSize = 24
 
+// flagTombstone marks an entry that deletes its key
+const flagTombstone uint8 = 1
+
 // EncodeEntry  entry into binary
 func EncodeEntry(e *Entry) ([]byte, uint32) {
 	e.KeySize = uint32(len(e.Key))
@@ -23,10 +31,61 @@ func EncodeEntry(e *Entry) ([]byte, uint32) {
 	size := entryHeaderSize + e.KeySize + e.ValueSize
 	buf := make([]byte, size)
 
+	// | CRC 4 | TS 8 | BKT 2 | FLAGS 1 | TYPE 1 | KS 4 | VS 4 | KEY ? | VALUE ? |
+	binary.BigEndian.PutUint64(buf[4:12], e.Timestamp)
+	binary.BigEndian.PutUint16(buf[12:14], e.Bucket)
+	buf[14] = e.Flags
+	buf[15] = uint8(e.Type)
+	binary.BigEndian.PutUint32(buf[16:20], e.KeySize)
+	binary.BigEndian.PutUint32(buf[20:24], e.ValueSize)
+
+	copy(buf[entryHeaderSize:entryHeaderSize+e.KeySize], e.Key)
+	copy(buf[entryHeaderSize+e.KeySize:size], e.Value)
+
+	e.CRC = crc32.ChecksumIEEE(buf[4:])
+	binary.BigEndian.PutUint32(buf[:4], e.CRC)
+	return buf, size
+}
+
+// DecodeEntry binary into entry
+func DecodeEntry(data []byte) *Entry {
+	if !validEntry(data) {
+		return nil
+	}
+
+	// | CRC 4 | TS 8 | BKT 2 | FLAGS 1 | TYPE 1 | KS 4 | VS 4 | KEY ? | VALUE ? |
+	var entry Entry
+	entry.CRC = binary.BigEndian.Uint32(data[:4])
+	entry.Timestamp = binary.BigEndian.Uint64(data[4:12])
+	entry.Bucket = binary.BigEndian.Uint16(data[12:14])
+	entry.Flags = data[14]
+	entry.Type = DataType(data[15])
+	entry.KeySize = binary.BigEndian.Uint32(data[16:20])
+	entry.ValueSize = binary.BigEndian.Uint32(data[20:24])
+	return entryPayload(&entry, data)
+}
+
+// decodeEntryHeader reads the key size, value size and flags out of an entry header
+func decodeEntryHeader(header []byte) (uint32, uint32, uint8) {
+	return binary.BigEndian.Uint32(header[16:20]), binary.BigEndian.Uint32(header[20:24]), header[14]
+}
+
+// encodeEntryV1 writes the headerless v1 layout, whose 10 and 5 byte windows
+// hold 8 and 4 byte integers. The spare bytes carry the bucket id, flags and
+// type.
+func encodeEntryV1(e *Entry) ([]byte, uint32) {
+	e.KeySize = uint32(len(e.Key))
+	e.ValueSize = uint32(len(e.Value))
+	size := entryHeaderSize + e.KeySize + e.ValueSize
+	buf := make([]byte, size)
+
 	// | CRC 4 | TS 10  | KS 5 | VS 5  | KEY ? | VALUE ? |
 	binary.BigEndian.PutUint64(buf[4:14], e.Timestamp)
+	binary.BigEndian.PutUint16(buf[12:14], e.Bucket)
 	binary.BigEndian.PutUint32(buf[14:19], e.KeySize)
+	buf[18] = e.Flags
 	binary.BigEndian.PutUint32(buf[19:24], e.ValueSize)
+	buf[23] = uint8(e.Type)
 
 	copy(buf[entryHeaderSize:entryHeaderSize+e.KeySize], e.Key)
 	copy(buf[entryHeaderSize+e.KeySize:size], e.Value)
@@ -36,23 +95,59 @@ func EncodeEntry(e *Entry) ([]byte, uint32) {
 	return buf, size
 }
 
-//DecodeEntry binary into entry
-func DecodeEntry(data []byte) *Entry {
-	if binary.BigEndian.Uint32(data[:4]) != crc32.ChecksumIEEE(data[4:]) {
+func decodeEntryV1(data []byte) *Entry {
+	if !validEntry(data) {
 		return nil
 	}
 
 	// | CRC 4 | TS 10  | KS 5 | VS 5  | KEY ? | VALUE ? |
 	var entry Entry
 	entry.CRC = binary.BigEndian.Uint32(data[:4])
-	entry.Timestamp = binary.BigEndian.Uint64(data[4:14])
-	entry.KeySize = binary.BigEndian.Uint32(data[14:19])
-	entry.ValueSize = binary.BigEndian.Uint32(data[19:24])
+	entry.Timestamp = binary.BigEndian.Uint64(data[4:12])
+	entry.Bucket = binary.BigEndian.Uint16(data[12:14])
+	entry.KeySize = binary.BigEndian.Uint32(data[14:18])
+	entry.Flags = data[18]
+	entry.ValueSize = binary.BigEndian.Uint32(data[19:23])
+	entry.Type = DataType(data[23])
+	return entryPayload(&entry, data)
+}
+
+func decodeEntryHeaderV1(header []byte) (uint32, uint32, uint8) {
+	return binary.BigEndian.Uint32(header[14:18]), binary.BigEndian.Uint32(header[19:23]), header[18]
+}
+
+// decodeEntryVersion decodes an entry written in the given format version
+func decodeEntryVersion(version uint16, data []byte) *Entry {
+	if version == formatV1 {
+		return decodeEntryV1(data)
+	}
+	return DecodeEntry(data)
+}
 
+// decodeEntryHeaderVersion reads an entry header written in the given format version
+func decodeEntryHeaderVersion(version uint16, header []byte) (uint32, uint32, uint8) {
+	if version == formatV1 {
+		return decodeEntryHeaderV1(header)
+	}
+	return decodeEntryHeader(header)
+}
+
+// is reports whether the entry was written for key in bucket.
+func (e *Entry) is(bucket uint16, key []byte) bool {
+	return e.Bucket == bucket && bytes.Equal(e.Key, key)
+}
+
+func validEntry(data []byte) bool {
+	return len(data) >= entryHeaderSize && binary.BigEndian.Uint32(data[:4]) == crc32.ChecksumIEEE(data[4:])
+}
+
+func entryPayload(entry *Entry, data []byte) *Entry {
+	if uint64(len(data)) != uint64(entryHeaderSize)+uint64(entry.KeySize)+uint64(entry.ValueSize) {
+		return nil
+	}
 	entry.Key = make([]byte, entry.KeySize)
 	entry.Value = make([]byte, entry.ValueSize)
 	copy(entry.Key, data[entryHeaderSize:entryHeaderSize+entry.KeySize])
-	copy(entry.Value, data[entryHeaderSize+entry.KeySize:entryHeaderSize+entry.KeySize+entry.ValueSize])
-
-	return &entry
+	copy(entry.Value, data[entryHeaderSize+entry.KeySize:])
+	return entry
 }
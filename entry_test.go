@@ -16,3 +16,17 @@ func TestEntry(t *testing.T) {
 	expect := DecodeEntry(data)
 	require.Equal(t, expect, &entry)
 }
+
+func TestEntryV1(t *testing.T) {
+	entry := Entry{
+		Timestamp: uint64(time.Now().UnixMicro()),
+		Bucket:    3,
+		Flags:     flagTombstone,
+		Type:      TypeList,
+		Key:       []byte("test"),
+		Value:     []byte("test"),
+	}
+	data, _ := encodeEntryV1(&entry)
+	expect := decodeEntryV1(data)
+	require.Equal(t, expect, &entry)
+}
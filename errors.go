@@ -0,0 +1,153 @@
+package flowdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Errors callers can tell apart with errors.Is. Errors carrying more detail
+// wrap one of them.
+var (
+	ErrKeyNotFound     = errors.New("key not exist")
+	ErrFieldNotFound   = errors.New("field not exist")
+	ErrWrongType       = errors.New("wrong type")
+	ErrInvalidArgument = errors.New("invalid argument")
+	ErrCorrupt         = errors.New("corrupt data")
+	ErrBucketNotFound  = errors.New("bucket not exist")
+	ErrBucketExists    = errors.New("bucket already exist")
+	ErrIndexNotFound   = errors.New("index not exist")
+	ErrIndexExists     = errors.New("index already exist")
+	ErrClosed          = errors.New("database closed")
+	// ErrReadOnly is returned for writes to a database opened by OpenReadOnly
+	ErrReadOnly = errors.New("database opened read only")
+	// ErrNotLeader is returned for writes sent to a node that cannot commit
+	// them to the raft log, ErrTimeout when raft did not take them in time
+	ErrNotLeader = errors.New("not the leader")
+	ErrTimeout   = errors.New("timed out")
+	// ErrWatchOverflow is what Watcher.Err reports once a reader fell so far
+	// behind that the buffer filled up
+	ErrWatchOverflow = errors.New("watch buffer overflow")
+	// ErrPositionLost is returned by a CDCReader started from a Position in
+	// files Merge has removed
+	ErrPositionLost = errors.New("cdc position no longer exists")
+	// ErrTierNotConfigured is returned by Tier without Options.ColdDirectory
+	ErrTierNotConfigured = errors.New("no cold directory")
+)
+
+var errEmptyKey = fmt.Errorf("%w: empty key", ErrInvalidArgument)
+
+// Status is the numeric code of an error kind that replies carry, so clients
+// can branch on it without parsing messages. The values never change.
+type Status uint16
+
+const (
+	StatusOK                Status = 0
+	StatusUnknown           Status = 1
+	StatusKeyNotFound       Status = 2
+	StatusFieldNotFound     Status = 3
+	StatusWrongType         Status = 4
+	StatusInvalidArgument   Status = 5
+	StatusCorrupt           Status = 6
+	StatusBucketNotFound    Status = 7
+	StatusBucketExists      Status = 8
+	StatusIndexNotFound     Status = 9
+	StatusIndexExists       Status = 10
+	StatusClosed            Status = 11
+	StatusNotLeader         Status = 12
+	StatusTimeout           Status = 13
+	StatusDiskFull          Status = 14
+	StatusWatchOverflow     Status = 15
+	StatusPositionLost      Status = 16
+	StatusTierNotConfigured Status = 17
+	StatusReadOnly          Status = 18
+)
+
+// statusErrors pairs every status but StatusOK and StatusUnknown with its
+// error. StatusOf goes down the list in order, so an error wrapping more than
+// one of them gets the status listed first; the catch-alls come last.
+var statusErrors = []struct {
+	status Status
+	err    error
+}{
+	{StatusKeyNotFound, ErrKeyNotFound},
+	{StatusFieldNotFound, ErrFieldNotFound},
+	{StatusWrongType, ErrWrongType},
+	{StatusBucketNotFound, ErrBucketNotFound},
+	{StatusBucketExists, ErrBucketExists},
+	{StatusIndexNotFound, ErrIndexNotFound},
+	{StatusIndexExists, ErrIndexExists},
+	{StatusNotLeader, ErrNotLeader},
+	{StatusTimeout, ErrTimeout},
+	{StatusDiskFull, ErrDiskFull},
+	{StatusWatchOverflow, ErrWatchOverflow},
+	{StatusPositionLost, ErrPositionLost},
+	{StatusTierNotConfigured, ErrTierNotConfigured},
+	{StatusReadOnly, ErrReadOnly},
+	{StatusClosed, ErrClosed},
+	{StatusCorrupt, ErrCorrupt},
+	{StatusInvalidArgument, ErrInvalidArgument},
+}
+
+// StatusOf returns the status of err: StatusOK for nil, StatusUnknown for
+// errors that wrap none of the exported ones.
+func StatusOf(err error) Status {
+	if err == nil {
+		return StatusOK
+	}
+	err = raftError(err)
+	for _, se := range statusErrors {
+		if errors.Is(err, se.err) {
+			return se.status
+		}
+	}
+	return StatusUnknown
+}
+
+// Err returns the error of a status, nil for StatusOK.
+func (s Status) Err() error {
+	if s == StatusOK {
+		return nil
+	}
+	for _, se := range statusErrors {
+		if se.status == s {
+			return se.err
+		}
+	}
+	return fmt.Errorf("status %d", uint16(s))
+}
+
+func (s Status) String() string {
+	switch s {
+	case StatusOK:
+		return "ok"
+	case StatusUnknown:
+		return "unknown error"
+	}
+	return s.Err().Error()
+}
+
+// replyHeaderSize is the status in front of every reply
+const replyHeaderSize = 2
+
+// EncodeReply frames a reply: the status, then the value, the JSON array of
+// values, "true" or "false", or the error message.
+func EncodeReply(status Status, data []byte) []byte {
+	buf := make([]byte, replyHeaderSize+len(data))
+	binary.BigEndian.PutUint16(buf, uint16(status))
+	copy(buf[replyHeaderSize:], data)
+	return buf
+}
+
+// EncodeError frames the reply to a command that failed with err.
+func EncodeError(err error) []byte {
+	return EncodeReply(StatusOf(err), []byte(err.Error()))
+}
+
+// DecodeReply splits a reply framed by EncodeReply.
+func DecodeReply(data []byte) (Status, []byte, error) {
+	if len(data) < replyHeaderSize {
+		return StatusUnknown, nil, fmt.Errorf("%w: short reply", ErrCorrupt)
+	}
+	return Status(binary.BigEndian.Uint16(data)), data[replyHeaderSize:], nil
+}
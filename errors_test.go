@@ -0,0 +1,101 @@
+package flowdb
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestStatus(t *testing.T) {
+	require.Equal(t, StatusOK, StatusOf(nil))
+	require.Equal(t, StatusUnknown, StatusOf(errors.New("boom")))
+	for _, se := range statusErrors {
+		require.Equal(t, se.status, StatusOf(se.err))
+		require.Equal(t, se.status, StatusOf(fmt.Errorf("context: %w", se.err)))
+		require.Equal(t, se.err, se.status.Err())
+		require.Equal(t, se.err.Error(), se.status.String())
+
+		// and back out of a reply to a command
+		status, data, err := DecodeReply(EncodeResult(&ApplyResult{Err: fmt.Errorf("%w: context", se.err)}))
+		require.NoError(t, err)
+		require.Equal(t, se.status, status)
+		require.Equal(t, se.err, status.Err())
+		require.Equal(t, se.err.Error()+": context", string(data))
+	}
+	require.NoError(t, StatusOK.Err())
+	require.Error(t, Status(999).Err())
+	require.Equal(t, StatusInvalidArgument, StatusOf(errEmptyKey))
+	require.Equal(t, StatusNotLeader, StatusOf(raft.ErrNotLeader))
+	require.Equal(t, StatusTimeout, StatusOf(raft.ErrEnqueueTimeout))
+	require.Equal(t, StatusClosed, StatusOf(raft.ErrRaftShutdown))
+
+	// the codes are part of the protocol
+	require.Equal(t, Status(2), StatusKeyNotFound)
+	require.Equal(t, Status(14), StatusDiskFull)
+	require.Equal(t, Status(18), StatusReadOnly)
+
+	// an error that is two kinds at once always gets the specific one
+	for i := 0; i < 20; i++ {
+		require.Equal(t, StatusKeyNotFound, StatusOf(twoKinds{}))
+	}
+}
+
+// twoKinds is an error that is both ErrCorrupt and ErrKeyNotFound
+type twoKinds struct{}
+
+func (twoKinds) Error() string {
+	return "two kinds"
+}
+
+func (twoKinds) Is(target error) bool {
+	return target == ErrCorrupt || target == ErrKeyNotFound
+}
+
+func TestReply(t *testing.T) {
+	status, data, err := DecodeReply(EncodeReply(StatusOK, []byte("v")))
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, status)
+	require.Equal(t, []byte("v"), data)
+
+	status, data, err = DecodeReply(EncodeError(fmt.Errorf("%w: bucket b", ErrBucketNotFound)))
+	require.NoError(t, err)
+	require.Equal(t, StatusBucketNotFound, status)
+	require.Equal(t, "bucket not exist: bucket b", string(data))
+
+	_, _, err = DecodeReply([]byte{1})
+	require.True(t, errors.Is(err, ErrCorrupt))
+
+	status, data, _ = DecodeReply(EncodeResult(&ApplyResult{Values: [][]byte{[]byte("a")}}))
+	require.Equal(t, StatusOK, status)
+	require.Equal(t, `["YQ=="]`, string(data))
+	status, data, _ = DecodeReply(EncodeResult(&ApplyResult{Ok: true}))
+	require.Equal(t, StatusOK, status)
+	require.Equal(t, "true", string(data))
+}
+
+func TestEngineErrors(t *testing.T) {
+	db := New(t.TempDir())
+	require.NoError(t, db.Load())
+
+	_, err := db.Get([]byte("missing"))
+	require.True(t, errors.Is(err, ErrKeyNotFound))
+
+	require.NoError(t, db.Put([]byte("k"), []byte("v")))
+	result := db.Query(&Command{Op: OpLRange, Key: []byte("k"), Start: 0, Stop: -1})
+	require.True(t, errors.Is(result.Err, ErrWrongType))
+	status, _, err := DecodeReply(EncodeResult(result))
+	require.NoError(t, err)
+	require.Equal(t, StatusWrongType, status)
+
+	result = db.Query(&Command{Op: OpPut, Key: []byte("k"), Value: []byte("v")})
+	require.Equal(t, StatusInvalidArgument, StatusOf(result.Err))
+
+	_, err = db.Bucket("nope").Get([]byte("k"))
+	require.True(t, errors.Is(err, ErrBucketNotFound))
+
+	_, err = DecodeCommand([]byte("{"))
+	require.True(t, errors.Is(err, ErrInvalidArgument))
+	require.NoError(t, db.Close())
+}
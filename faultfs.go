@@ -0,0 +1,243 @@
+package flowdb
+
+import (
+	"errors"
+	"os"
+	"path"
+	"sync"
+)
+
+// ErrInjected is what a Fault returns when it has no Err of its own
+var ErrInjected = errors.New("injected fault")
+
+// Fault describes calls a FaultFS should fail
+type Fault struct {
+	// Op is the call to fail: open, read, write, sync, truncate, close,
+	// readdir, mkdir, remove, rename or stat. Empty matches every call.
+	Op string
+	// Path is a path.Match pattern for the file name; empty matches every
+	// file. Rename matches on the old name.
+	Path string
+	// After lets that many matching calls through before the fault fires
+	After int
+	// Times is how often the fault fires; zero fires on every matching call
+	Times int
+	// Err is returned by the failing call, ErrInjected if nil
+	Err error
+	// ShortWrite makes a failing write store that many bytes before it
+	// returns the error
+	ShortWrite int
+	// Crash crashes the file system instead of returning an error
+	Crash bool
+
+	seen, fired int
+}
+
+// FaultFS wraps an FS and fails the calls matching the faults injected into
+// it. After a crash every call fails with ErrCrashed; the wrapped FS, when it
+// is a MemFS, is crashed too and can be reopened to test recovery.
+type FaultFS struct {
+	fs FS
+
+	mu      sync.Mutex
+	faults  []*Fault
+	crashed bool
+}
+
+// NewFaultFS returns a FaultFS over fs with no faults injected
+func NewFaultFS(fs FS) *FaultFS {
+	return &FaultFS{fs: fs}
+}
+
+// Inject adds a fault
+func (f *FaultFS) Inject(fault Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.faults = append(f.faults, &fault)
+}
+
+// Reset removes every fault
+func (f *FaultFS) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.faults = nil
+}
+
+// Seen returns how many calls the i-th fault injected since the last Reset
+// has matched
+func (f *FaultFS) Seen(i int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.faults[i].seen
+}
+
+// Crash simulates losing power
+func (f *FaultFS) Crash() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.crash()
+}
+
+// Crashed reports whether the file system has crashed
+func (f *FaultFS) Crashed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.crashed
+}
+
+// crash marks the file system crashed. The caller must hold f.mu.
+func (f *FaultFS) crash() {
+	f.crashed = true
+	if m, ok := f.fs.(*MemFS); ok {
+		m.Crash()
+	}
+}
+
+// fault returns the fault that fires for op on name, if any.
+func (f *FaultFS) fault(op, name string) (*Fault, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.crashed {
+		return nil, ErrCrashed
+	}
+	for _, fault := range f.faults {
+		if fault.Op != "" && fault.Op != op {
+			continue
+		}
+		if fault.Path != "" {
+			if ok, _ := path.Match(fault.Path, name); !ok {
+				continue
+			}
+		}
+		fault.seen++
+		if fault.seen <= fault.After || fault.Times > 0 && fault.fired >= fault.Times {
+			continue
+		}
+		fault.fired++
+		if fault.Crash {
+			f.crash()
+			return nil, ErrCrashed
+		}
+		if fault.Err != nil {
+			return fault, fault.Err
+		}
+		return fault, ErrInjected
+	}
+	return nil, nil
+}
+
+func (f *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if _, err := f.fault("open", name); err != nil {
+		return nil, err
+	}
+	file, err := f.fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: f, name: name}, nil
+}
+
+func (f *FaultFS) ReadDir(dir string) ([]os.FileInfo, error) {
+	if _, err := f.fault("readdir", dir); err != nil {
+		return nil, err
+	}
+	return f.fs.ReadDir(dir)
+}
+
+func (f *FaultFS) MkdirAll(dir string, perm os.FileMode) error {
+	if _, err := f.fault("mkdir", dir); err != nil {
+		return err
+	}
+	return f.fs.MkdirAll(dir, perm)
+}
+
+func (f *FaultFS) Remove(name string) error {
+	if _, err := f.fault("remove", name); err != nil {
+		return err
+	}
+	return f.fs.Remove(name)
+}
+
+func (f *FaultFS) RemoveAll(name string) error {
+	if _, err := f.fault("remove", name); err != nil {
+		return err
+	}
+	return f.fs.RemoveAll(name)
+}
+
+func (f *FaultFS) Rename(oldName, newName string) error {
+	if _, err := f.fault("rename", oldName); err != nil {
+		return err
+	}
+	return f.fs.Rename(oldName, newName)
+}
+
+func (f *FaultFS) Stat(name string) (os.FileInfo, error) {
+	if _, err := f.fault("stat", name); err != nil {
+		return nil, err
+	}
+	return f.fs.Stat(name)
+}
+
+type faultFile struct {
+	File
+	fs   *FaultFS
+	name string
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if _, err := f.fs.fault("read", f.name); err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := f.fs.fault("read", f.name); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	fault, err := f.fs.fault("write", f.name)
+	if err == nil {
+		return f.File.Write(p)
+	}
+	if fault == nil || fault.ShortWrite <= 0 {
+		return 0, err
+	}
+	n := fault.ShortWrite
+	if n > len(p) {
+		n = len(p)
+	}
+	n, _ = f.File.Write(p[:n])
+	return n, err
+}
+
+func (f *faultFile) Sync() error {
+	if _, err := f.fs.fault("sync", f.name); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if _, err := f.fs.fault("truncate", f.name); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
+
+func (f *faultFile) Close() error {
+	if _, err := f.fs.fault("close", f.name); err != nil {
+		return err
+	}
+	return f.File.Close()
+}
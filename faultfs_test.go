@@ -0,0 +1,48 @@
+package flowdb
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestFaultFS(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+	options := DefaultOptions("db")
+	options.FS = fs
+
+	fs.Inject(Fault{Op: "mkdir", Times: 1})
+	db := NewWithOptions(options)
+	require.Equal(t, ErrInjected, db.Load())
+	require.NoError(t, db.Load())
+
+	// a torn write fails the put without shifting later entries
+	diskFull := errors.New("no space left on device")
+	fs.Inject(Fault{Op: "write", Path: "db/data/*.data", After: 1, Times: 1, ShortWrite: 5, Err: diskFull})
+	require.NoError(t, db.Put([]byte("a"), []byte("1")))
+	require.Equal(t, diskFull, db.Put([]byte("b"), []byte("2")))
+	require.NoError(t, db.Put([]byte("c"), []byte("3")))
+	value, err := db.Get([]byte("c"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("3"), value)
+	require.NoError(t, db.Sync())
+
+	fs.Inject(Fault{Op: "sync", Crash: true})
+	require.NoError(t, db.Put([]byte("d"), []byte("4")))
+	require.Equal(t, ErrCrashed, db.Sync())
+	require.True(t, fs.Crashed())
+	require.Equal(t, ErrCrashed, db.Put([]byte("e"), []byte("5")))
+
+	// reopen on the file system underneath, as after a reboot
+	options.FS = fs.fs
+	db = NewWithOptions(options)
+	require.NoError(t, db.Load())
+	value, err = db.Get([]byte("c"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("3"), value)
+	_, err = db.Get([]byte("b"))
+	require.Error(t, err)
+	_, err = db.Get([]byte("d"))
+	require.Error(t, err)
+	require.NoError(t, db.Close())
+}
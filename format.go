@@ -0,0 +1,67 @@
+package flowdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Every data, hint and snapshot file starts with a header naming its kind and
+// format version. Files written before the header existed have none and are
+// read as version 1.
+//
+// | MAGIC 4 | VERSION 2 | KIND 1 | RESERVED 1 |
+const (
+	fileMagic      = "FLDB"
+	fileHeaderSize = 8
+
+	fileKindData     uint8 = 1
+	fileKindHint     uint8 = 2
+	fileKindSnapshot uint8 = 3
+
+	formatV1 uint16 = 1
+	formatV2 uint16 = 2
+	// formatV3 adds a CRC to every hint record; entries are laid out as in v2
+	formatV3 uint16 = 3
+	// formatV4 changes the hash of keys outside the default bucket, which
+	// hints record; records are laid out as in v3
+	formatV4 uint16 = 4
+
+	// formatVersion is what new files are written in
+	formatVersion = formatV4
+)
+
+func encodeFileHeader(kind uint8, version uint16) []byte {
+	buf := make([]byte, fileHeaderSize)
+	copy(buf[:4], fileMagic)
+	binary.BigEndian.PutUint16(buf[4:6], version)
+	buf[6] = kind
+	return buf
+}
+
+// decodeFileHeader returns the format version of a file starting with header
+// and where its records begin. A file without a header is version 1.
+func decodeFileHeader(header []byte, kind uint8) (uint16, int64, error) {
+	if len(header) < fileHeaderSize || string(header[:4]) != fileMagic {
+		return formatV1, 0, nil
+	}
+	version := binary.BigEndian.Uint16(header[4:6])
+	if header[6] != kind {
+		return 0, 0, errors.New("unexpected file kind")
+	}
+	if version < formatV2 || version > formatVersion {
+		return 0, 0, fmt.Errorf("unsupported format version %d", version)
+	}
+	return version, fileHeaderSize, nil
+}
+
+// readFileHeader reads the header at the start of r.
+func readFileHeader(r io.ReaderAt, kind uint8) (uint16, int64, error) {
+	header := make([]byte, fileHeaderSize)
+	n, err := r.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+	return decodeFileHeader(header[:n], kind)
+}
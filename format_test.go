@@ -0,0 +1,121 @@
+package flowdb
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestFileHeader(t *testing.T) {
+	version, start, err := decodeFileHeader(encodeFileHeader(fileKindData, formatVersion), fileKindData)
+	require.NoError(t, err)
+	require.Equal(t, formatVersion, version)
+	require.Equal(t, int64(fileHeaderSize), start)
+
+	_, _, err = decodeFileHeader(encodeFileHeader(fileKindHint, formatVersion), fileKindData)
+	require.Error(t, err)
+	_, _, err = decodeFileHeader(encodeFileHeader(fileKindData, formatVersion+1), fileKindData)
+	require.Error(t, err)
+
+	// headerless files are the v1 layout
+	version, start, err = decodeFileHeader([]byte{0, 1, 2}, fileKindData)
+	require.NoError(t, err)
+	require.Equal(t, formatV1, version)
+	require.Equal(t, int64(0), start)
+}
+
+// writeV1Files lays out a data file and its hint file the way FlowDB wrote
+// them before the file header existed.
+func writeV1Files(t *testing.T, dir string, id int64, entries []*Entry) {
+	var data, hints []byte
+	for _, entry := range entries {
+		buf, size := encodeEntryV1(entry)
+		hint, _ := encodeHintV1(&Hint{
+			Timestamp: entry.Timestamp,
+			ValuePos:  uint64(len(data)),
+			Key:       bucketKeyHash(FNV1a, entry.Bucket, entry.Key),
+			Bucket:    entry.Bucket,
+		})
+		data = append(data, buf[:size]...)
+		hints = append(hints, hint...)
+	}
+	require.NoError(t, os.MkdirAll(path.Join(dir, "data"), FM))
+	require.NoError(t, os.MkdirAll(path.Join(dir, "hint"), FM))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "data", fmt.Sprintf("%d.data", id)), data, FM))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "hint", fmt.Sprintf("%d.hint", id)), hints, FM))
+}
+
+func TestReadV1Files(t *testing.T) {
+	dir := t.TempDir()
+	writeV1Files(t, dir, 1, []*Entry{
+		{Timestamp: 1, Key: []byte("a"), Value: []byte("1")},
+		{Timestamp: 2, Key: []byte("b"), Value: []byte("2")},
+		{Timestamp: 3, Key: []byte("a"), Flags: flagTombstone},
+	})
+
+	db := New(dir)
+	require.NoError(t, db.Load())
+	_, err := db.Get([]byte("a"))
+	require.Error(t, err)
+	value, err := db.Get([]byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), value)
+
+	// new writes go to a fresh file in the current format
+	require.NoError(t, db.Put([]byte("c"), []byte("3")))
+	require.Equal(t, int64(2), db.dataFileVersion)
+	require.NoError(t, db.Merge())
+	require.NoError(t, db.Close())
+
+	db = New(dir)
+	require.NoError(t, db.Load())
+	for _, id := range db.dataFileIds() {
+		require.Equal(t, formatVersion, db.fileVersions[id])
+	}
+	value, err = db.Get([]byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), value)
+	require.NoError(t, db.Close())
+}
+
+func TestReadV3BucketHints(t *testing.T) {
+	dir := t.TempDir()
+	entry := &Entry{Timestamp: 1, Bucket: 1, Key: []byte("k"), Value: []byte("user")}
+	data, size := EncodeEntry(entry)
+	hint, _ := EncodeHint(&Hint{
+		Timestamp: entry.Timestamp,
+		ValuePos:  fileHeaderSize,
+		Key:       prefixedKeyHash(FNV1a, entry.Bucket, entry.Key),
+		ValueSize: size,
+		Bucket:    entry.Bucket,
+	})
+	require.NoError(t, os.MkdirAll(path.Join(dir, "data"), FM))
+	require.NoError(t, os.MkdirAll(path.Join(dir, "hint"), FM))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "data", "1.data"), append(encodeFileHeader(fileKindData, formatV3), data...), FM))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "hint", "1.hint"), append(encodeFileHeader(fileKindHint, formatV3), hint...), FM))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, bucketFileName), []byte(`{"next_id":2,"buckets":{"users":1}}`), FM))
+
+	// v3 hints hashed bucket keys the old way, the keydir uses the new one
+	db := New(dir)
+	require.NoError(t, db.Load())
+	value, err := db.Bucket("users").Get([]byte("k"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("user"), value)
+	require.NoError(t, db.Close())
+
+	report, err := Fsck(dir)
+	require.NoError(t, err)
+	require.Empty(t, report.Corrupt)
+}
+
+func TestRefuseUnknownVersion(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(path.Join(dir, "data"), FM))
+	header := encodeFileHeader(fileKindData, formatVersion+1)
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "data", "1.data"), header, FM))
+
+	require.Error(t, New(dir).Load())
+}
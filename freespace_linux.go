@@ -0,0 +1,12 @@
+package flowdb
+
+import "syscall"
+
+// FreeSpace returns the bytes an unprivileged user can still write under dir.
+func (osFS) FreeSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package flowdb
+
+import "errors"
+
+// FreeSpace is not known where statfs is not available.
+func (osFS) FreeSpace(dir string) (int64, error) {
+	return 0, errors.New("free space is not known on this platform")
+}
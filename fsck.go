@@ -0,0 +1,285 @@
+package flowdb
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// CorruptRange is a span of a data or hint file that does not hold what it
+// should. Start and End are byte offsets, End exclusive.
+type CorruptRange struct {
+	File   string
+	Start  int64
+	End    int64
+	Reason string
+}
+
+// FileReport is what Fsck found in one data file and its hint file
+type FileReport struct {
+	FileId  int64
+	Version uint16
+	Size    int64
+	Entries int
+	Hints   int
+}
+
+// FsckReport is the result of checking a data directory
+type FsckReport struct {
+	Files   []FileReport
+	Corrupt []CorruptRange
+	// Orphans are files in the data and hint directories that belong to no
+	// data file
+	Orphans []string
+	Keys    int
+}
+
+// OK reports whether Fsck found nothing wrong
+func (r *FsckReport) OK() bool {
+	return len(r.Corrupt) == 0 && len(r.Orphans) == 0
+}
+
+// Fsck checks the data directory of a closed database without changing it.
+// Every entry is CRC checked, every hint is matched against the entry it
+// points at, and the keys the data files hold are counted.
+func Fsck(directory string) (*FsckReport, error) {
+	return New(directory).fsck()
+}
+
+func (f *FlowDB) fsck() (*FsckReport, error) {
+	if err := f.useRecordedHasher(); err != nil {
+		return nil, err
+	}
+	if err := f.loadManifest(); err != nil {
+		return nil, err
+	}
+	if err := f.loadBuckets(); err != nil {
+		return nil, err
+	}
+
+	directory := f.options.DatabaseDirectory
+	report := &FsckReport{}
+	dataIds := f.dataFileIds()
+	hasData := make(map[int64]bool, len(dataIds))
+	for _, id := range dataIds {
+		hasData[id] = true
+	}
+	report.Orphans = append(report.Orphans, strayFiles(f.options.FS, path.Join(directory, "data"), ".data")...)
+	report.Orphans = append(report.Orphans, strayFiles(f.options.FS, path.Join(directory, "hint"), ".hint")...)
+	for _, id := range f.hintFileIds() {
+		if !hasData[id] {
+			report.Orphans = append(report.Orphans, f.hintFilePath(id))
+		}
+	}
+
+	keys := make(keyCounter)
+	for _, id := range dataIds {
+		file, err := f.fsckFile(id, report, func(entry *Entry) {
+			keys.add(f, entry)
+		})
+		if err != nil {
+			return nil, err
+		}
+		report.Files = append(report.Files, file)
+	}
+	report.Keys = len(keys)
+	return report, nil
+}
+
+// fsckFile checks data file id and its hint file, adding what is wrong with
+// them to report and calling fn with every valid entry in order.
+func (f *FlowDB) fsckFile(id int64, report *FsckReport, fn func(*Entry)) (FileReport, error) {
+	file := FileReport{FileId: id}
+	fd, err := f.options.FS.OpenFile(f.dataFilePath(id), os.O_RDONLY, 0)
+	if err != nil {
+		return file, err
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil {
+		return file, err
+	}
+	file.Size = info.Size()
+
+	version, start, err := readFileHeader(fd, fileKindData)
+	if err != nil {
+		report.Corrupt = append(report.Corrupt, CorruptRange{
+			File:   f.dataFilePath(id),
+			End:    file.Size,
+			Reason: err.Error(),
+		})
+		return file, nil
+	}
+	file.Version = version
+
+	type located struct {
+		hash  uint64
+		size  uint32
+		flags uint8
+	}
+	entries := make(map[int64]located)
+	err = scanEntries(fd, version, start, file.Size, func(entry *Entry, offset int64) {
+		file.Entries++
+		entries[offset] = located{
+			hash:  f.hintKeyHash(version, entry.Bucket, entry.Key),
+			size:  entryHeaderSize + uint32(len(entry.Key)) + uint32(len(entry.Value)),
+			flags: entry.Flags,
+		}
+		fn(entry)
+	}, func(from, to int64, reason string) {
+		report.Corrupt = append(report.Corrupt, CorruptRange{File: f.dataFilePath(id), Start: from, End: to, Reason: reason})
+	})
+	if err != nil {
+		return file, err
+	}
+
+	hintPath := f.hintFilePath(id)
+	err = scanHints(f.options.FS, hintPath, func(hint *Hint, offset, size int64) {
+		file.Hints++
+		entry, ok := entries[int64(hint.ValuePos)]
+		if ok && entry.hash == hint.Key && (hint.ValueSize == 0 || hint.ValueSize == entry.size && hint.Flags == entry.flags) {
+			return
+		}
+		report.Corrupt = append(report.Corrupt, CorruptRange{File: hintPath, Start: offset, End: offset + size, Reason: "hint does not match data"})
+	}, func(from, to int64, reason string) {
+		report.Corrupt = append(report.Corrupt, CorruptRange{File: hintPath, Start: from, End: to, Reason: reason})
+	})
+	if os.IsNotExist(err) {
+		report.Corrupt = append(report.Corrupt, CorruptRange{File: hintPath, Reason: "missing hint file"})
+		return file, nil
+	}
+	if err != nil {
+		return file, err
+	}
+	if file.Hints < file.Entries {
+		report.Corrupt = append(report.Corrupt, CorruptRange{
+			File:   hintPath,
+			Reason: fmt.Sprintf("%d entries have no hint", file.Entries-file.Hints),
+		})
+	}
+	return file, nil
+}
+
+// scanEntries walks the entries of a data file between start and end. Valid
+// entries go to fn; a span that holds none goes to corrupt, and the walk picks
+// up at the next offset where a valid entry starts.
+func scanEntries(r io.ReaderAt, version uint16, start, end int64, fn func(*Entry, int64), corrupt func(int64, int64, string)) error {
+	badFrom, reason := int64(-1), ""
+	header := make([]byte, entryHeaderSize)
+	for offset := start; offset < end; {
+		entry, size, why, err := readEntryAt(r, version, offset, end, header)
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			if badFrom < 0 {
+				badFrom, reason = offset, why
+			}
+			offset++
+			continue
+		}
+		if badFrom >= 0 {
+			corrupt(badFrom, offset, reason)
+			badFrom = -1
+		}
+		fn(entry, offset)
+		offset += size
+	}
+	if badFrom >= 0 {
+		corrupt(badFrom, end, reason)
+	}
+	return nil
+}
+
+// readEntryAt decodes the entry at offset, or says why there is none.
+func readEntryAt(r io.ReaderAt, version uint16, offset, end int64, header []byte) (*Entry, int64, string, error) {
+	if end-offset < entryHeaderSize {
+		return nil, 0, "truncated entry", nil
+	}
+	if _, err := r.ReadAt(header, offset); err != nil {
+		return nil, 0, "", err
+	}
+	keySize, valueSize, _ := decodeEntryHeaderVersion(version, header)
+	size := int64(entryHeaderSize) + int64(keySize) + int64(valueSize)
+	if size > end-offset {
+		return nil, 0, "bad entry header", nil
+	}
+	data := make([]byte, size)
+	if _, err := r.ReadAt(data, offset); err != nil {
+		return nil, 0, "", err
+	}
+	entry := decodeEntryVersion(version, data)
+	if entry == nil {
+		return nil, 0, "crc mismatch", nil
+	}
+	return entry, size, "", nil
+}
+
+// scanHints walks the records of a hint file, reporting records that fail
+// their CRC check and a torn tail to corrupt.
+func scanHints(fs FS, file string, fn func(*Hint, int64, int64), corrupt func(int64, int64, string)) error {
+	data, err := readFile(fs, file)
+	if err != nil {
+		return err
+	}
+	version, start, err := decodeFileHeader(data, fileKindHint)
+	if err != nil {
+		corrupt(0, fileHeaderSize, err.Error())
+		return nil
+	}
+	decode, size := DecodeHint, int64(hintHeaderSize)
+	switch version {
+	case formatV1:
+		decode, size = decodeHintV1, int64(hintHeaderSizeV1)
+	case formatV2:
+		decode, size = decodeHintV2, int64(hintHeaderSizeV2)
+	}
+
+	offset := start
+	for ; offset+size <= int64(len(data)); offset += size {
+		hint := decode(data[offset : offset+size])
+		if hint == nil {
+			corrupt(offset, offset+size, "crc mismatch")
+			continue
+		}
+		fn(hint, offset, size)
+	}
+	if offset < int64(len(data)) {
+		corrupt(offset, int64(len(data)), "truncated hint record")
+	}
+	return nil
+}
+
+// strayFiles lists the files in dir that are not named <id><ext>.
+func strayFiles(fs FS, dir, ext string) []string {
+	files, _ := fs.ReadDir(dir)
+	ids := make(map[string]bool)
+	for _, id := range listFileIds(fs, dir, ext) {
+		ids[fmt.Sprintf("%d%s", id, ext)] = true
+	}
+
+	var stray []string
+	for _, file := range files {
+		if !ids[file.Name()] {
+			stray = append(stray, path.Join(dir, file.Name()))
+		}
+	}
+	return stray
+}
+
+// keyCounter replays entries in file order to count the keys they leave
+// behind, the way the keydir would.
+type keyCounter map[uint64]bool
+
+func (c keyCounter) add(f *FlowDB, entry *Entry) {
+	if f.buckets.isDropped(entry.Bucket) {
+		return
+	}
+	sum64 := f.keyHash(entry.Bucket, entry.Key)
+	if entry.Flags&flagTombstone != 0 {
+		delete(c, sum64)
+	} else {
+		c[sum64] = true
+	}
+}
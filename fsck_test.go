@@ -0,0 +1,58 @@
+package flowdb
+
+import (
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func TestFsck(t *testing.T) {
+	dir := t.TempDir()
+	db := New(dir)
+	require.NoError(t, db.Load())
+	require.NoError(t, db.Put([]byte("a"), []byte("1")))
+	require.NoError(t, db.Put([]byte("b"), []byte("2")))
+	require.NoError(t, db.Put([]byte("c"), []byte("3")))
+	require.NoError(t, db.Delete([]byte("a")))
+	require.NoError(t, db.Close())
+
+	report, err := Fsck(dir)
+	require.NoError(t, err)
+	require.True(t, report.OK())
+	require.Len(t, report.Files, 1)
+	require.Equal(t, 4, report.Files[0].Entries)
+	require.Equal(t, 4, report.Files[0].Hints)
+	require.Equal(t, 2, report.Keys)
+
+	// damage the value of "b", the second entry
+	file := path.Join(dir, "data", "1.data")
+	data, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	size := int64(entryHeaderSize + 2)
+	data[fileHeaderSize+size+entryHeaderSize+1] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(file, data, FM))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "hint", "7.hint"), nil, FM))
+
+	report, err = Fsck(dir)
+	require.NoError(t, err)
+	require.False(t, report.OK())
+	require.Equal(t, 3, report.Files[0].Entries)
+	require.Equal(t, 1, report.Keys)
+	require.Equal(t, []string{path.Join(dir, "hint", "7.hint")}, report.Orphans)
+
+	var dataRange, hintRange bool
+	for _, r := range report.Corrupt {
+		switch r.File {
+		case file:
+			require.Equal(t, fileHeaderSize+size, r.Start)
+			require.Equal(t, fileHeaderSize+2*size, r.End)
+			dataRange = true
+		case path.Join(dir, "hint", "1.hint"):
+			require.Equal(t, "hint does not match data", r.Reason)
+			hintRange = true
+		}
+	}
+	require.True(t, dataRange)
+	require.True(t, hintRange)
+}
@@ -1,62 +1,215 @@
 package flowdb
 
 import (
+	"bufio"
+	"encoding/binary"
 	"fmt"
 	"github.com/hashicorp/raft"
 	"io"
-	"log"
-	"time"
+	"math"
 )
 
+// raftBucket is a bucket id CreateBucket never hands out. It keeps the index
+// of the last applied raft log so a restarted node does not apply it twice.
+const raftBucket uint16 = math.MaxUint16
+
+var appliedIndexKey = []byte("applied_index")
+
+// replicated reports whether the raft log writes to bucket. Named buckets are
+// local to each node: the log has no commands for them, so snapshots leave
+// them out.
+func replicated(bucket uint16) bool {
+	return bucket == defaultBucket || bucket == raftBucket
+}
+
 type FSM struct {
-	DataBase database
+	DataBase *FlowDB
 }
 
-func NewFSM() *FSM {
+func NewFSM(db *FlowDB) *FSM {
 	return &FSM{
-		DataBase: newDatabase(),
+		DataBase: db,
 	}
 }
 
 func (f *FSM) Apply(log *raft.Log) interface{} {
-	fmt.Println("apply data", string(log.Data))
-	f.DataBase.Put([]byte("test"), log.Data) //todo
-	return nil
+	c, err := DecodeCommand(log.Data)
+	if err != nil {
+		return &ApplyResult{Err: err}
+	}
+	return f.DataBase.applyCommand(c, log.Index)
 }
 
 func (f *FSM) Snapshot() (raft.FSMSnapshot, error) {
-	return &f.DataBase, nil
+	entries, err := f.DataBase.liveEntries()
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot{entries: entries}, nil
 }
 
-func (f *FSM) Restore(snapshot io.ReadCloser) error {
-	return nil
-}
+func (f *FSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
 
-type database struct {
-}
+	r := bufio.NewReader(rc)
+	header, _ := r.Peek(fileHeaderSize)
+	version, start, err := decodeFileHeader(header, fileKindSnapshot)
+	if err != nil {
+		return err
+	}
+	if _, err := r.Discard(int(start)); err != nil {
+		return err
+	}
 
-func newDatabase() database {
-	return database{}
+	var entries []*Entry
+	buf := make([]byte, entryHeaderSize)
+	for {
+		_, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		keySize, valueSize, _ := decodeEntryHeaderVersion(version, buf)
+		data := make([]byte, entryHeaderSize+keySize+valueSize)
+		copy(data, buf)
+		if _, err := io.ReadFull(r, data[entryHeaderSize:]); err != nil {
+			return err
+		}
+		entry := decodeEntryVersion(version, data)
+		if entry == nil {
+			return fmt.Errorf("%w: snapshot entry", ErrCorrupt)
+		}
+		entries = append(entries, entry)
+	}
+
+	return f.DataBase.restore(entries)
 }
 
-func (d *database) Get(key []byte) []byte {
-	return key
+// snapshot holds a copy of every live entry, written out as encoded entries
+// behind a file header
+type snapshot struct {
+	entries []*Entry
 }
 
-func (d *database) Put(key, value []byte) {
-	fmt.Println(key, value)
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(encodeFileHeader(fileKindSnapshot, formatVersion)); err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+	for _, entry := range s.entries {
+		data, _ := EncodeEntry(entry)
+		if _, err := sink.Write(data); err != nil {
+			_ = sink.Cancel()
+			return err
+		}
+	}
+	return sink.Close()
 }
 
-func (d *database) Persist(sink raft.SnapshotSink) error {
-	_, err := sink.Write([]byte(time.Now().String()))
+func (s *snapshot) Release() {}
+
+// applyCommand executes a command taken from the raft log at index, unless
+// the database has already seen that index. The command and the applied index
+// are written under f.writeMu, so reads go on meanwhile.
+func (f *FlowDB) applyCommand(c *Command, index uint64) *ApplyResult {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	applied, err := f.appliedIndex()
 	if err != nil {
-		log.Println(err)
+		return &ApplyResult{Err: err}
+	}
+	if index <= applied {
+		return &ApplyResult{}
+	}
+
+	result := f.execute(c)
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, index)
+	if err := f.putLocked(raftBucket, appliedIndexKey, buf, TypeString); err != nil && result.Err == nil {
+		result.Err = err
 	}
-	err = sink.Close()
+	return result
+}
+
+// appliedIndex returns the last raft index applied to the database. The
+// caller must hold f.mu.
+func (f *FlowDB) appliedIndex() (uint64, error) {
+	record := f.keydir.get(f.keyHash(raftBucket, appliedIndexKey))
+	if record == nil {
+		return 0, nil
+	}
+	entry, err := f.readEntry(record)
 	if err != nil {
-		log.Println(err)
+		return 0, err
 	}
-	return nil
+	return binary.BigEndian.Uint64(entry.Value), nil
 }
 
-func (d *database) Release() {}
+// liveEntries reads every live entry of the replicated buckets in file order.
+func (f *FlowDB) liveEntries() ([]*Entry, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	records := f.sortedRecords()
+	entries := make([]*Entry, 0, len(records))
+	for _, record := range records {
+		if !replicated(record.bucket) {
+			continue
+		}
+		entry, err := f.readEntry(record)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// restore replaces the content of the replicated buckets with entries.
+// Watchers see the keys dropped as deletes and the keys written as puts.
+// Entries of other buckets, which older snapshots carried, are skipped.
+func (f *FlowDB) restore(entries []*Entry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	keep := make(map[uint64]bool, len(entries))
+	for _, entry := range entries {
+		keep[f.keyHash(entry.Bucket, entry.Key)] = true
+	}
+	var stale []*KeyDirRecord
+	f.keydir.each(func(sum64 uint64, record *KeyDirRecord) {
+		if replicated(record.bucket) && !keep[sum64] {
+			stale = append(stale, record)
+		}
+	})
+	for _, record := range stale {
+		entry, err := f.readEntry(record)
+		if err != nil {
+			return err
+		}
+		if err := f.delete(entry.Bucket, entry.Key); err != nil {
+			return err
+		}
+	}
+	for _, entry := range entries {
+		if !replicated(entry.Bucket) {
+			continue
+		}
+		if err := f.writeEntry(entry); err != nil {
+			return err
+		}
+		f.notify(entry.Bucket, Event{
+			Type:      EventPut,
+			DataType:  entry.Type,
+			Key:       entry.Key,
+			Value:     entry.Value,
+			Timestamp: int64(entry.Timestamp),
+		})
+	}
+	return f.buildSecondaryIndexes()
+}
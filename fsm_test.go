@@ -0,0 +1,104 @@
+package flowdb
+
+import (
+	"bytes"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+)
+
+func TestFSMApply(t *testing.T) {
+	db := New(t.TempDir())
+	require.NoError(t, db.Load())
+	fsm := NewFSM(db)
+
+	apply := func(index uint64, c *Command) *ApplyResult {
+		data, err := EncodeCommand(c)
+		require.NoError(t, err)
+		return fsm.Apply(&raft.Log{Index: index, Data: data}).(*ApplyResult)
+	}
+
+	result := apply(1, &Command{Op: OpPutIfAbsent, Key: []byte("k"), Value: []byte("v1")})
+	require.NoError(t, result.Err)
+	require.True(t, result.Ok)
+	result = apply(2, &Command{Op: OpCompareAndSwap, Key: []byte("k"), Old: []byte("v1"), Value: []byte("v2")})
+	require.NoError(t, result.Err)
+	require.True(t, result.Ok)
+
+	// a replayed log is skipped
+	result = apply(1, &Command{Op: OpPut, Key: []byte("k"), Value: []byte("v1")})
+	require.False(t, result.Ok)
+	value, err := db.Get([]byte("k"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2"), value)
+
+	result = apply(3, &Command{Op: OpDeleteIfEquals, Key: []byte("k"), Value: []byte("v2")})
+	require.NoError(t, result.Err)
+	require.True(t, result.Ok)
+	_, err = db.Get([]byte("k"))
+	require.Error(t, err)
+	require.NoError(t, db.Close())
+}
+
+// bufferSink is a raft.SnapshotSink keeping the snapshot in memory
+type bufferSink struct {
+	bytes.Buffer
+}
+
+func (s *bufferSink) ID() string    { return "test" }
+func (s *bufferSink) Cancel() error { return nil }
+func (s *bufferSink) Close() error  { return nil }
+
+func TestFSMSnapshotRestore(t *testing.T) {
+	db := New(t.TempDir())
+	require.NoError(t, db.Load())
+	fsm := NewFSM(db)
+	data, err := EncodeCommand(&Command{Op: OpPut, Key: []byte("a"), Value: []byte("1")})
+	require.NoError(t, err)
+	require.Nil(t, fsm.Apply(&raft.Log{Index: 1, Data: data}).(*ApplyResult).Err)
+	bucket, err := db.CreateBucket("local")
+	require.NoError(t, err)
+	require.NoError(t, bucket.Put([]byte("bk1"), []byte("v")))
+
+	snap, err := fsm.Snapshot()
+	require.NoError(t, err)
+	sink := &bufferSink{}
+	require.NoError(t, snap.Persist(sink))
+	snap.Release()
+	require.NoError(t, db.Close())
+
+	other := New(t.TempDir())
+	require.NoError(t, other.Load())
+	require.NoError(t, other.Put([]byte("old"), []byte("x")))
+	w := other.Watch(nil)
+	require.NoError(t, NewFSM(other).Restore(io.NopCloser(&sink.Buffer)))
+
+	value, err := other.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), value)
+	_, err = other.Get([]byte("old"))
+	require.Equal(t, ErrKeyNotFound, err)
+	applied, err := other.appliedIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), applied)
+
+	// watchers see the reset
+	require.Len(t, w.C, 2)
+	event := <-w.C
+	require.Equal(t, EventDelete, event.Type)
+	require.Equal(t, []byte("old"), event.Key)
+	event = <-w.C
+	require.Equal(t, EventPut, event.Type)
+	require.Equal(t, []byte("a"), event.Key)
+	require.Equal(t, []byte("1"), event.Value)
+	w.Close()
+
+	// named buckets are local and stay out of the snapshot
+	require.Empty(t, other.Buckets())
+	bucket, err = other.CreateBucket("other")
+	require.NoError(t, err)
+	_, err = bucket.Get([]byte("bk1"))
+	require.Equal(t, ErrKeyNotFound, err)
+	require.NoError(t, other.Close())
+}
@@ -1,5 +1,30 @@
 package flowdb
 
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// Hasher maps keys to keydir slots. Name is recorded in the database
+// directory, so it has to stay the same for as long as the hash does.
+type Hasher interface {
+	Name() string
+	Sum64(key []byte) uint64
+}
+
+var (
+	// FNV1a is the hasher FlowDB has always used
+	FNV1a Hasher = fnv64a{}
+	// XXHash64 hashes 8 bytes at a time and is much faster on longer keys
+	XXHash64 Hasher = xxhash64{}
+)
+
+// hashers are the hashers a database can be reopened with by name
+var hashers = map[string]Hasher{
+	FNV1a.Name():    FNV1a,
+	XXHash64.Name(): XXHash64,
+}
+
 type fnv64a struct{}
 
 const (
@@ -11,6 +36,10 @@ const (
 	prime64 = 1099511628211
 )
 
+func (fnv64a) Name() string {
+	return "fnv1a"
+}
+
 func (fnv64a) Sum64(key []byte) uint64 {
 	var hash uint64 = offset64
 	for i := 0; i < len(key); i++ {
@@ -24,3 +53,77 @@ func Hash(key []byte) uint64 {
 	f := fnv64a{}
 	return f.Sum64(key)
 }
+
+type xxhash64 struct{}
+
+const (
+	// xxHash64 primes with a zero seed.
+	// See https://github.com/Cyan4973/xxHash/blob/dev/doc/xxhash_spec.md
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func (xxhash64) Name() string {
+	return "xxhash64"
+}
+
+func (xxhash64) Sum64(key []byte) uint64 {
+	n := len(key)
+	var hash uint64
+	if n >= 32 {
+		var seed uint64
+		v1 := seed + xxPrime1 + xxPrime2
+		v2 := seed + xxPrime2
+		v3 := seed
+		v4 := seed - xxPrime1
+		for ; len(key) >= 32; key = key[32:] {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(key[0:8]))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(key[8:16]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(key[16:24]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(key[24:32]))
+		}
+		hash = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		hash = xxMergeRound(hash, v1)
+		hash = xxMergeRound(hash, v2)
+		hash = xxMergeRound(hash, v3)
+		hash = xxMergeRound(hash, v4)
+	} else {
+		hash = xxPrime5
+	}
+	hash += uint64(n)
+
+	for ; len(key) >= 8; key = key[8:] {
+		hash ^= xxRound(0, binary.LittleEndian.Uint64(key[:8]))
+		hash = bits.RotateLeft64(hash, 27)*xxPrime1 + xxPrime4
+	}
+	if len(key) >= 4 {
+		hash ^= uint64(binary.LittleEndian.Uint32(key[:4])) * xxPrime1
+		hash = bits.RotateLeft64(hash, 23)*xxPrime2 + xxPrime3
+		key = key[4:]
+	}
+	for _, b := range key {
+		hash ^= uint64(b) * xxPrime5
+		hash = bits.RotateLeft64(hash, 11) * xxPrime1
+	}
+
+	hash ^= hash >> 33
+	hash *= xxPrime2
+	hash ^= hash >> 29
+	hash *= xxPrime3
+	hash ^= hash >> 32
+	return hash
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMergeRound(acc, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}
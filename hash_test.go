@@ -8,3 +8,9 @@ import (
 func TestHash(t *testing.T) {
 	require.Equal(t, uint64(0xf9e6e6ef197c2b25), Hash([]byte("test")))
 }
+
+func TestXXHash64(t *testing.T) {
+	require.Equal(t, uint64(0xef46db3751d8e999), XXHash64.Sum64(nil))
+	require.Equal(t, uint64(0x44bc2cf5ad770999), XXHash64.Sum64([]byte("abc")))
+	require.Equal(t, uint64(0xfbcea83c8a378bf1), XXHash64.Sum64([]byte("Nobody inspects the spammish repetition")))
+}
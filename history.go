@@ -0,0 +1,171 @@
+package flowdb
+
+import (
+	"bytes"
+	"os"
+	"time"
+)
+
+// Version is one write of a key
+type Version struct {
+	Timestamp int64
+	Value     []byte
+	Deleted   bool
+}
+
+// History returns every version of key still in the data files, oldest
+// first. A delete shows up as a version with Deleted set.
+func (f *FlowDB) History(key []byte) ([]Version, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	return f.history(defaultBucket, key)
+}
+
+// GetAt returns the value key had at timestamp, in microseconds since the
+// epoch like Entry.Timestamp.
+func (f *FlowDB) GetAt(key []byte, timestamp int64) ([]byte, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	versions, err := f.history(defaultBucket, key)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].Timestamp > timestamp {
+			continue
+		}
+		if versions[i].Deleted {
+			break
+		}
+		return versions[i].Value, nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+// history finds the versions of key through the hint files, which only have
+// to be matched on the key hash before the entry is read. The caller must
+// hold f.writeMu, which keeps the active hint file still, or f.mu
+// exclusively.
+func (f *FlowDB) history(bucket uint16, key []byte) ([]Version, error) {
+	var versions []Version
+	for _, id := range f.openFileIds() {
+		found, err := f.fileHistory(id, bucket, key)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, found...)
+	}
+	return versions, nil
+}
+
+// fileHistory returns the versions of key in one data file, scanning the
+// data file itself when its hint file is missing or corrupt. The caller must
+// hold f.writeMu or f.mu exclusively.
+func (f *FlowDB) fileHistory(fileId int64, bucket uint16, key []byte) ([]Version, error) {
+	sum64 := f.keyHash(bucket, key)
+	var versions []Version
+	add := func(entry *Entry) {
+		if entry.Bucket != bucket || !bytes.Equal(entry.Key, key) {
+			return
+		}
+		versions = append(versions, Version{
+			Timestamp: int64(entry.Timestamp),
+			Value:     entry.Value,
+			Deleted:   entry.Flags&flagTombstone != 0,
+		})
+	}
+
+	scan := func() error {
+		return f.forEachEntry(fileId, func(entry *Entry, _ int64) error {
+			add(entry)
+			return nil
+		})
+	}
+	if _, err := f.options.FS.Stat(f.hintFilePath(fileId)); os.IsNotExist(err) {
+		return versions, scan()
+	}
+
+	err := f.forEachHint(fileId, func(hint *Hint) error {
+		if hint.Key != sum64 || hint.Bucket != bucket {
+			return nil
+		}
+		size, _, err := f.entryHeader(fileId, int64(hint.ValuePos))
+		if err != nil {
+			return err
+		}
+		entry, err := f.readEntry(&KeyDirRecord{fileId: fileId, ValueSize: size, ValuePos: int64(hint.ValuePos)})
+		if err != nil {
+			return err
+		}
+		add(entry)
+		return nil
+	})
+	if err == errCorruptHint {
+		versions = nil
+		err = scan()
+	}
+	return versions, err
+}
+
+type location struct {
+	fileId int64
+	offset int64
+}
+
+// mergeFilter decides which entries of the files being merged are copied:
+// the live ones, and with a retention window every version written inside
+// it plus the version each key had when the window opened. The caller must
+// hold f.mu.
+func (f *FlowDB) mergeFilter(files []int64) (func(int64, int64, *Entry) bool, error) {
+	live := make(map[location]bool, f.keydir.len())
+	f.keydir.each(func(_ uint64, record *KeyDirRecord) {
+		live[location{record.fileId, record.ValuePos}] = true
+	})
+	if f.options.HistoryRetention <= 0 {
+		return func(fileId, offset int64, _ *Entry) bool {
+			return live[location{fileId, offset}]
+		}, nil
+	}
+
+	cutoff := uint64(time.Now().Add(-f.options.HistoryRetention).UnixMicro())
+	atCutoff := make(map[uint64]location)
+	for _, id := range files {
+		fileId := id
+		err := f.forEachEntry(fileId, func(entry *Entry, offset int64) error {
+			if entry.Timestamp >= cutoff {
+				return nil
+			}
+			sum64 := f.keyHash(entry.Bucket, entry.Key)
+			if entry.Flags&flagTombstone != 0 {
+				delete(atCutoff, sum64)
+			} else {
+				atCutoff[sum64] = location{fileId, offset}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return func(fileId, offset int64, entry *Entry) bool {
+		loc := location{fileId, offset}
+		if live[loc] {
+			return true
+		}
+		if entry.Bucket == raftBucket || f.buckets.isDropped(entry.Bucket) {
+			return false
+		}
+		if entry.Timestamp >= cutoff {
+			return true
+		}
+		at, ok := atCutoff[f.keyHash(entry.Bucket, entry.Key)]
+		return ok && at == loc
+	}, nil
+}
@@ -0,0 +1,92 @@
+package flowdb
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	dir := t.TempDir()
+	options := DefaultOptions(dir)
+	options.HistoryRetention = time.Hour
+	db := NewWithOptions(options)
+	require.NoError(t, db.Load())
+
+	require.NoError(t, db.Put([]byte("k"), []byte("v1")))
+	require.NoError(t, db.Put([]byte("other"), []byte("x")))
+	time.Sleep(time.Millisecond)
+	require.NoError(t, db.Put([]byte("k"), []byte("v2")))
+	time.Sleep(time.Millisecond)
+	require.NoError(t, db.Delete([]byte("k")))
+	time.Sleep(time.Millisecond)
+	require.NoError(t, db.Put([]byte("k"), []byte("v3")))
+
+	check := func() {
+		versions, err := db.History([]byte("k"))
+		require.NoError(t, err)
+		require.Len(t, versions, 4)
+		require.Equal(t, []byte("v1"), versions[0].Value)
+		require.True(t, versions[2].Deleted)
+		require.Equal(t, []byte("v3"), versions[3].Value)
+
+		value, err := db.GetAt([]byte("k"), versions[1].Timestamp)
+		require.NoError(t, err)
+		require.Equal(t, []byte("v2"), value)
+		_, err = db.GetAt([]byte("k"), versions[2].Timestamp)
+		require.Error(t, err)
+		_, err = db.GetAt([]byte("k"), versions[0].Timestamp-1)
+		require.Error(t, err)
+	}
+	check()
+
+	// merge keeps the versions inside the retention window
+	require.NoError(t, db.Merge())
+	check()
+	require.NoError(t, db.Close())
+
+	db = New(dir)
+	require.NoError(t, db.Load())
+	check()
+	value, err := db.Get([]byte("k"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v3"), value)
+
+	// without retention merge keeps the live version only
+	require.NoError(t, db.Merge())
+	versions, err := db.History([]byte("k"))
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+	require.Equal(t, []byte("v3"), versions[0].Value)
+	require.NoError(t, db.Close())
+}
+
+func TestHistoryWithoutHints(t *testing.T) {
+	dir := t.TempDir()
+	db := New(dir)
+	require.NoError(t, db.Load())
+	require.NoError(t, db.Put([]byte("k"), []byte("v1")))
+	time.Sleep(time.Millisecond)
+	require.NoError(t, db.Put([]byte("k"), []byte("v2")))
+	db.mu.Lock()
+	require.NoError(t, db.rotateActiveFile())
+	db.mu.Unlock()
+	require.NoError(t, db.Put([]byte("k"), []byte("v3")))
+	require.NoError(t, db.Close())
+
+	// the versions of a data file without a hint file are read from the data
+	require.NoError(t, os.Remove(path.Join(dir, "hint", "1.hint")))
+	db = New(dir)
+	require.NoError(t, db.Load())
+	versions, err := db.History([]byte("k"))
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+	require.Equal(t, []byte("v1"), versions[0].Value)
+	require.Equal(t, []byte("v3"), versions[2].Value)
+	value, err := db.GetAt([]byte("k"), versions[1].Timestamp)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2"), value)
+	require.NoError(t, db.Close())
+}
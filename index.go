@@ -0,0 +1,209 @@
+package flowdb
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// IndexFunc extracts the values a record is indexed under. A record without
+// values is left out of the index.
+type IndexFunc func(key, value []byte) [][]byte
+
+// JSONPathIndex indexes JSON records by the field at a dotted path such as
+// "user.email". Strings are indexed by their content, other scalars by their
+// JSON text, and arrays by each of their elements.
+func JSONPathIndex(path string) IndexFunc {
+	fields := strings.Split(path, ".")
+	return func(key, value []byte) [][]byte {
+		var doc interface{}
+		if err := json.Unmarshal(value, &doc); err != nil {
+			return nil
+		}
+		for _, field := range fields {
+			object, ok := doc.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			if doc, ok = object[field]; !ok {
+				return nil
+			}
+		}
+		if array, ok := doc.([]interface{}); ok {
+			var values [][]byte
+			for _, item := range array {
+				if v := jsonIndexValue(item); v != nil {
+					values = append(values, v)
+				}
+			}
+			return values
+		}
+		if v := jsonIndexValue(doc); v != nil {
+			return [][]byte{v}
+		}
+		return nil
+	}
+}
+
+func jsonIndexValue(v interface{}) []byte {
+	switch v := v.(type) {
+	case nil, map[string]interface{}, []interface{}:
+		return nil
+	case string:
+		return []byte(v)
+	default:
+		data, _ := json.Marshal(v)
+		return data
+	}
+}
+
+// secondaryIndex maps index values to the primary keys holding them, and
+// keeps the reverse mapping to unindex a key when it changes.
+type secondaryIndex struct {
+	fn      IndexFunc
+	entries map[string]map[string]struct{}
+	values  map[string][]string
+}
+
+func newSecondaryIndex(fn IndexFunc) *secondaryIndex {
+	return &secondaryIndex{
+		fn:      fn,
+		entries: make(map[string]map[string]struct{}),
+		values:  make(map[string][]string),
+	}
+}
+
+func (s *secondaryIndex) add(key, value []byte) {
+	s.remove(key)
+	var values []string
+	for _, v := range s.fn(key, value) {
+		keys, ok := s.entries[string(v)]
+		if !ok {
+			keys = make(map[string]struct{})
+			s.entries[string(v)] = keys
+		}
+		keys[string(key)] = struct{}{}
+		values = append(values, string(v))
+	}
+	if len(values) > 0 {
+		s.values[string(key)] = values
+	}
+}
+
+func (s *secondaryIndex) remove(key []byte) {
+	for _, v := range s.values[string(key)] {
+		delete(s.entries[v], string(key))
+		if len(s.entries[v]) == 0 {
+			delete(s.entries, v)
+		}
+	}
+	delete(s.values, string(key))
+}
+
+// CreateIndex declares a secondary index over the keys of the database and
+// builds it from the data already stored. Indexes live in memory, so they
+// are declared again on every start; one declared before Load is built by
+// Load.
+func (f *FlowDB) CreateIndex(name string, fn IndexFunc) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.secondaryIndexes[name]; ok {
+		return ErrIndexExists
+	}
+	index := newSecondaryIndex(fn)
+	if len(f.openFileIds()) > 0 {
+		if err := f.buildSecondaryIndex(index); err != nil {
+			return err
+		}
+	}
+	f.secondaryIndexes[name] = index
+	return nil
+}
+
+func (f *FlowDB) DropIndex(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.secondaryIndexes[name]; !ok {
+		return ErrIndexNotFound
+	}
+	delete(f.secondaryIndexes, name)
+	return nil
+}
+
+// Lookup returns the sorted primary keys indexed under value by index name.
+func (f *FlowDB) Lookup(name string, value []byte) ([][]byte, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	index, ok := f.secondaryIndexes[name]
+	if !ok {
+		return nil, ErrIndexNotFound
+	}
+	keys := make([]string, 0, len(index.entries[string(value)]))
+	for key := range index.entries[string(value)] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := make([][]byte, len(keys))
+	for i, key := range keys {
+		result[i] = []byte(key)
+	}
+	return result, nil
+}
+
+// indexPut and indexDelete keep the secondary indexes in step with a write.
+// The caller must hold f.writeMu or f.mu exclusively.
+func (f *FlowDB) indexPut(bucket uint16, key, value []byte) {
+	if bucket != defaultBucket {
+		return
+	}
+	for _, index := range f.secondaryIndexes {
+		index.add(key, value)
+	}
+}
+
+func (f *FlowDB) indexDelete(bucket uint16, key []byte) {
+	if bucket != defaultBucket {
+		return
+	}
+	for _, index := range f.secondaryIndexes {
+		index.remove(key)
+	}
+}
+
+// buildSecondaryIndexes rebuilds every declared index from the data files.
+// The caller must hold f.mu exclusively.
+func (f *FlowDB) buildSecondaryIndexes() error {
+	for name, index := range f.secondaryIndexes {
+		index = newSecondaryIndex(index.fn)
+		if err := f.buildSecondaryIndex(index); err != nil {
+			return err
+		}
+		f.secondaryIndexes[name] = index
+	}
+	return nil
+}
+
+// buildSecondaryIndex indexes the string keys of the default bucket, the ones
+// indexPut sees.
+func (f *FlowDB) buildSecondaryIndex(index *secondaryIndex) error {
+	for _, record := range f.sortedRecords() {
+		if record.bucket != defaultBucket {
+			continue
+		}
+		entry, err := f.readEntry(record)
+		if err != nil {
+			return err
+		}
+		if entry.Type != TypeString {
+			continue
+		}
+		index.add(entry.Key, entry.Value)
+	}
+	return nil
+}
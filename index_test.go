@@ -0,0 +1,80 @@
+package flowdb
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestSecondaryIndex(t *testing.T) {
+	dir := t.TempDir()
+	db := New(dir)
+	require.NoError(t, db.Load())
+
+	require.NoError(t, db.Put([]byte("user:1"), []byte(`{"name":"alice","address":{"city":"paris"},"tags":["a","b"]}`)))
+	require.NoError(t, db.CreateIndex("city", JSONPathIndex("address.city")))
+	require.NoError(t, db.CreateIndex("tag", JSONPathIndex("tags")))
+	require.NoError(t, db.Put([]byte("user:2"), []byte(`{"name":"bob","address":{"city":"paris"},"tags":["b"]}`)))
+	require.NoError(t, db.Put([]byte("user:3"), []byte(`{"name":"carol","address":{"city":"rome"}}`)))
+	require.NoError(t, db.Put([]byte("raw"), []byte("not json")))
+
+	keys, err := db.Lookup("city", []byte("paris"))
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("user:1"), []byte("user:2")}, keys)
+	keys, err = db.Lookup("tag", []byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("user:1"), []byte("user:2")}, keys)
+
+	// updates and deletes move the key out of its old index values
+	require.NoError(t, db.Put([]byte("user:2"), []byte(`{"name":"bob","address":{"city":"rome"}}`)))
+	require.NoError(t, db.Delete([]byte("user:1")))
+	keys, err = db.Lookup("city", []byte("paris"))
+	require.NoError(t, err)
+	require.Empty(t, keys)
+	require.NoError(t, db.Close())
+
+	// indexes declared before Load are rebuilt from the data files
+	db = New(dir)
+	require.NoError(t, db.CreateIndex("city", JSONPathIndex("address.city")))
+	require.NoError(t, db.Load())
+	keys, err = db.Lookup("city", []byte("rome"))
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("user:2"), []byte("user:3")}, keys)
+	_, err = db.Lookup("tag", []byte("b"))
+	require.Error(t, err)
+	require.NoError(t, db.Close())
+
+	// a read-only open has no active file but indexes its data all the same
+	db, err = OpenReadOnly(dir)
+	require.NoError(t, err)
+	require.NoError(t, db.CreateIndex("city", JSONPathIndex("address.city")))
+	keys, err = db.Lookup("city", []byte("rome"))
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("user:2"), []byte("user:3")}, keys)
+	require.NoError(t, db.Close())
+}
+
+func TestSecondaryIndexSkipsStructures(t *testing.T) {
+	dir := t.TempDir()
+	everything := func(key, value []byte) [][]byte { return [][]byte{[]byte("all")} }
+	db := New(dir)
+	require.NoError(t, db.CreateIndex("all", everything))
+	require.NoError(t, db.Load())
+	require.NoError(t, db.Put([]byte("s"), []byte("v")))
+	_, err := db.RPush([]byte("l"), []byte("a"))
+	require.NoError(t, err)
+	_, err = db.HSet([]byte("h"), []byte("f"), []byte("v"))
+	require.NoError(t, err)
+	keys, err := db.Lookup("all", []byte("all"))
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("s")}, keys)
+	require.NoError(t, db.Close())
+
+	// the rebuild on Load finds the same keys the writes indexed
+	db = New(dir)
+	require.NoError(t, db.CreateIndex("all", everything))
+	require.NoError(t, db.Load())
+	keys, err = db.Lookup("all", []byte("all"))
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("s")}, keys)
+	require.NoError(t, db.Close())
+}
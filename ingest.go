@@ -0,0 +1,317 @@
+package flowdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// Builder writes data and hint files offline from keys added in increasing
+// order, for Ingest to adopt. It never keeps more than the last key in
+// memory, so it can build databases far larger than Put could load quickly.
+type Builder struct {
+	db       *FlowDB
+	fileSize int64
+
+	data   File
+	hint   File
+	offset int64
+	last   []byte
+	count  int
+}
+
+// NewBuilder returns a builder writing into options.DatabaseDirectory on
+// options.FS, which has to be empty or missing.
+func NewBuilder(options Options) (*Builder, error) {
+	b := &Builder{db: NewWithOptions(options), fileSize: defaultMaxFileSize}
+	for _, dir := range []string{"data", "hint"} {
+		if err := b.db.options.FS.MkdirAll(path.Join(options.DatabaseDirectory, dir), FM); err != nil {
+			return nil, err
+		}
+	}
+	if len(b.db.dataFileIds()) > 0 {
+		return nil, fmt.Errorf("%w: builder directory is not empty", ErrInvalidArgument)
+	}
+	if err := b.db.saveMeta(dirMeta{Hasher: b.db.options.Hasher.Name()}); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Add appends key and value. Keys must come in strictly increasing order.
+func (b *Builder) Add(key, value []byte) error {
+	if len(key) == 0 {
+		return errEmptyKey
+	}
+	if b.count > 0 && bytes.Compare(key, b.last) <= 0 {
+		return fmt.Errorf("%w: keys must be added in increasing order", ErrInvalidArgument)
+	}
+	if b.data == nil || b.offset >= b.fileSize {
+		if err := b.nextFile(); err != nil {
+			return err
+		}
+	}
+
+	entry := &Entry{Timestamp: uint64(time.Now().UnixMicro()), Key: key, Value: value}
+	data, size := EncodeEntry(entry)
+	if _, err := b.data.Write(data); err != nil {
+		return err
+	}
+	hint, _ := EncodeHint(&Hint{
+		Timestamp: entry.Timestamp,
+		ValuePos:  uint64(b.offset),
+		Key:       b.db.keyHash(defaultBucket, key),
+		ValueSize: size,
+	})
+	if _, err := b.hint.Write(hint); err != nil {
+		return err
+	}
+	b.offset += int64(size)
+	b.last = append(b.last[:0], key...)
+	b.count++
+	return nil
+}
+
+// Close flushes the files written so far.
+func (b *Builder) Close() error {
+	if b.data == nil {
+		return nil
+	}
+	return b.closeFile()
+}
+
+// nextFile starts the next data and hint file pair.
+func (b *Builder) nextFile() error {
+	if b.data != nil {
+		if err := b.closeFile(); err != nil {
+			return err
+		}
+	}
+	b.db.dataFileVersion++
+	data, err := b.db.openDataFile(b.db.dataFileVersion)
+	if err != nil {
+		return err
+	}
+	hint, err := b.db.openHintFile(b.db.dataFileVersion)
+	if err != nil {
+		_ = data.Close()
+		return err
+	}
+	b.data, b.hint, b.offset = data, hint, fileHeaderSize
+	if err := writeFileHeader(data, fileKindData); err != nil {
+		return err
+	}
+	return writeFileHeader(hint, fileKindHint)
+}
+
+func (b *Builder) closeFile() error {
+	for _, fd := range []File{b.data, b.hint} {
+		if err := fd.Sync(); err != nil {
+			return err
+		}
+		if err := fd.Close(); err != nil {
+			return err
+		}
+	}
+	b.data, b.hint = nil, nil
+	return nil
+}
+
+// Ingest adopts the files a Builder wrote into directory, which is read
+// through the database's FS: a Builder has to write to the same FS, though
+// the files may sit on another device, in which case they are copied rather
+// than renamed. The files are checked first, then moved into the database
+// under new version numbers above the active file, so their keys replace
+// older values, and indexed from their hints while the lock is held. The
+// moves are recorded before the first one, so Load finishes an Ingest a crash
+// interrupted, and a failed one is undone. Writes after Ingest go to a fresh
+// active file behind them.
+func (f *FlowDB) Ingest(directory string) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	src := NewWithOptions(Options{DatabaseDirectory: directory, FS: f.options.FS})
+	report, err := src.fsck()
+	if err != nil {
+		return err
+	}
+	if !report.OK() {
+		return fmt.Errorf("%w: ingest files are damaged", ErrCorrupt)
+	}
+	if src.options.Hasher.Name() != f.options.Hasher.Name() {
+		return fmt.Errorf("%w: ingest files were built with a different hasher", ErrInvalidArgument)
+	}
+	if len(report.Files) == 0 {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.closeActiveFile(); err != nil {
+		return err
+	}
+	intent := ingestIntent{Files: make(map[int64]ingestSource)}
+	for i, file := range report.Files {
+		intent.Files[f.dataFileVersion+1+int64(i)] = ingestSource{
+			Data: src.dataFilePath(file.FileId),
+			Hint: src.hintFilePath(file.FileId),
+		}
+	}
+	ids := intent.ids()
+	err = f.saveIngestIntent(intent)
+	if err == nil {
+		if err = f.moveIngested(intent); err != nil {
+			if f.unmoveIngested(intent) != nil || f.removeIngestIntent() != nil {
+				// Load finishes the Ingest; the active file keeps clear of it
+				f.dataFileVersion = ids[len(ids)-1]
+			}
+		}
+	}
+	if err != nil {
+		if createErr := f.createActiveFile(); createErr != nil {
+			return createErr
+		}
+		return err
+	}
+
+	for _, id := range ids {
+		fd, err := f.options.FS.OpenFile(f.dataFilePath(id), os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		f.addDataFile(id, fd, report.Files[id-ids[0]].Version)
+		if err := f.forEachHint(id, func(hint *Hint) error {
+			return f.indexHint(id, hint)
+		}); err != nil {
+			return err
+		}
+	}
+	f.dataFileVersion = ids[len(ids)-1]
+	if err := f.createActiveFile(); err != nil {
+		return err
+	}
+	if err := f.removeIngestIntent(); err != nil {
+		return err
+	}
+	if err := f.measureDiskUsage(); err != nil {
+		return err
+	}
+	return f.buildSecondaryIndexes()
+}
+
+const ingestFileName = "ingest.json"
+
+// ingestIntent records the files an Ingest moves into the database, by the
+// id each one gets. It is saved before the first file moves and removed once
+// they all have.
+type ingestIntent struct {
+	Files map[int64]ingestSource `json:"files"`
+}
+
+// ingestSource is where the data and hint file of an ingested id come from
+type ingestSource struct {
+	Data string `json:"data"`
+	Hint string `json:"hint"`
+}
+
+// ids returns the ids of the intent in order.
+func (i ingestIntent) ids() []int64 {
+	ids := make([]int64, 0, len(i.Files))
+	for id := range i.Files {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+	return ids
+}
+
+// moveIngested moves the files of intent into the database. Files already
+// moved are skipped, so it can pick up where a crash stopped it.
+func (f *FlowDB) moveIngested(intent ingestIntent) error {
+	for _, id := range intent.ids() {
+		source := intent.Files[id]
+		if err := f.moveIngestFile(source.Data, f.dataFilePath(id)); err != nil {
+			return err
+		}
+		if err := f.moveIngestFile(source.Hint, f.hintFilePath(id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unmoveIngested puts the files of a failed Ingest back where they came from.
+// The caller must hold f.mu.
+func (f *FlowDB) unmoveIngested(intent ingestIntent) error {
+	for _, id := range intent.ids() {
+		source := intent.Files[id]
+		if err := f.moveIngestFile(f.dataFilePath(id), source.Data); err != nil {
+			return err
+		}
+		if err := f.moveIngestFile(f.hintFilePath(id), source.Hint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveIngestFile renames from to to, or copies it over when they are on
+// different devices. A missing from has been moved already.
+func (f *FlowDB) moveIngestFile(from, to string) error {
+	fs := f.options.FS
+	if _, err := fs.Stat(from); os.IsNotExist(err) {
+		return nil
+	}
+	err := fs.Rename(from, to)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyFile(fs, from, to); err != nil {
+		return err
+	}
+	return fs.Remove(from)
+}
+
+// finishIngest completes the Ingest a crash interrupted, if there is one, by
+// moving the rest of its files in.
+func (f *FlowDB) finishIngest() error {
+	data, err := readFile(f.options.FS, path.Join(f.options.DatabaseDirectory, ingestFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var intent ingestIntent
+	if err := json.Unmarshal(data, &intent); err != nil {
+		return fmt.Errorf("%s: %v", ingestFileName, err)
+	}
+	if err := f.moveIngested(intent); err != nil {
+		return err
+	}
+	return f.removeIngestIntent()
+}
+
+// saveIngestIntent writes the intent through a temporary file like
+// saveBuckets.
+func (f *FlowDB) saveIngestIntent(intent ingestIntent) error {
+	data, err := json.Marshal(intent)
+	if err != nil {
+		return err
+	}
+	file := path.Join(f.options.DatabaseDirectory, ingestFileName)
+	if err := writeFile(f.options.FS, file+".tmp", data, FM); err != nil {
+		return err
+	}
+	return f.options.FS.Rename(file+".tmp", file)
+}
+
+func (f *FlowDB) removeIngestIntent() error {
+	return f.options.FS.Remove(path.Join(f.options.DatabaseDirectory, ingestFileName))
+}
@@ -0,0 +1,114 @@
+package flowdb
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestIngest(t *testing.T) {
+	dir := t.TempDir()
+	db := New(path.Join(dir, "db"))
+	require.NoError(t, db.Load())
+	require.NoError(t, db.Put([]byte("k:000"), []byte("old")))
+	require.NoError(t, db.Put([]byte("other"), []byte("kept")))
+
+	b, err := NewBuilder(DefaultOptions(path.Join(dir, "build")))
+	require.NoError(t, err)
+	b.fileSize = 256
+	for i := 0; i < 50; i++ {
+		require.NoError(t, b.Add([]byte(fmt.Sprintf("k:%03d", i)), []byte(fmt.Sprintf("v%d", i))))
+	}
+	require.Error(t, b.Add([]byte("k:010"), []byte("late")))
+	require.NoError(t, b.Close())
+	require.Greater(t, len(b.db.dataFileIds()), 1)
+
+	require.NoError(t, db.Ingest(path.Join(dir, "build")))
+	require.Empty(t, listFileIds(OSFS, path.Join(dir, "build", "data"), ".data"))
+	value, err := db.Get([]byte("k:000"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v0"), value)
+	value, err = db.Get([]byte("other"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("kept"), value)
+
+	// writes after ingest win over the ingested values
+	require.NoError(t, db.Put([]byte("k:001"), []byte("new")))
+	require.NoError(t, db.Close())
+
+	db = New(path.Join(dir, "db"))
+	require.NoError(t, db.Load())
+	value, err = db.Get([]byte("k:001"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("new"), value)
+	value, err = db.Get([]byte("k:049"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v49"), value)
+	require.Equal(t, 51, db.keydir.len())
+	require.NoError(t, db.Close())
+}
+
+// buildKeys has a Builder write keys k:000 to k:049 into several files under
+// build on fs.
+func buildKeys(t *testing.T, fs FS) {
+	b, err := NewBuilder(Options{DatabaseDirectory: "build", FS: fs})
+	require.NoError(t, err)
+	b.fileSize = 256
+	for i := 0; i < 50; i++ {
+		require.NoError(t, b.Add([]byte(fmt.Sprintf("k:%03d", i)), []byte(fmt.Sprintf("v%d", i))))
+	}
+	require.NoError(t, b.Close())
+}
+
+func TestIngestCrash(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+	options := DefaultOptions("db")
+	options.FS = fs
+	db := NewWithOptions(options)
+	require.NoError(t, db.Load())
+	require.NoError(t, db.Put([]byte("other"), []byte("kept")))
+	buildKeys(t, fs)
+
+	fs.Inject(Fault{Op: "rename", Path: "build/data/2.data", Crash: true})
+	require.Error(t, db.Ingest("build"))
+	require.True(t, fs.Crashed())
+
+	// recovery finishes the moves the crash cut short
+	options.FS = fs.fs
+	db = NewWithOptions(options)
+	require.NoError(t, db.Load())
+	require.Equal(t, 51, db.keydir.len())
+	value, err := db.Get([]byte("k:049"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v49"), value)
+	require.Empty(t, listFileIds(fs.fs, "build/data", ".data"))
+	_, err = fs.fs.Stat(path.Join("db", ingestFileName))
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, db.Put([]byte("k:001"), []byte("new")))
+	require.NoError(t, db.Close())
+}
+
+func TestIngestRollback(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+	options := DefaultOptions("db")
+	options.FS = fs
+	db := NewWithOptions(options)
+	require.NoError(t, db.Load())
+	buildKeys(t, fs)
+	built := listFileIds(fs, "build/data", ".data")
+
+	// a failed Ingest leaves the files where they were and nothing visible
+	fs.Inject(Fault{Op: "rename", Path: "build/data/2.data", Times: 1})
+	require.Equal(t, ErrInjected, db.Ingest("build"))
+	require.Equal(t, built, listFileIds(fs, "build/data", ".data"))
+	require.Equal(t, 0, db.keydir.len())
+	_, err := fs.Stat(path.Join("db", ingestFileName))
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, db.Put([]byte("other"), []byte("kept")))
+
+	require.NoError(t, db.Ingest("build"))
+	require.Equal(t, 51, db.keydir.len())
+	require.NoError(t, db.Close())
+}
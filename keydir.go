@@ -0,0 +1,100 @@
+package flowdb
+
+import "sync"
+
+// keydirShards is how many independently locked parts the keydir has
+const keydirShards = 64
+
+// keydir maps the hash of every live key to the record of its newest entry.
+// It is split into shards with locks of their own, so readers only wait for
+// a writer touching the same shard.
+type keydir struct {
+	shards [keydirShards]keydirShard
+}
+
+type keydirShard struct {
+	mu      sync.RWMutex
+	records map[uint64]*KeyDirRecord
+}
+
+func newKeydir() *keydir {
+	k := &keydir{}
+	for i := range k.shards {
+		k.shards[i].records = make(map[uint64]*KeyDirRecord)
+	}
+	return k
+}
+
+func (k *keydir) shard(sum64 uint64) *keydirShard {
+	return &k.shards[sum64%keydirShards]
+}
+
+// get returns the record of sum64, or nil if the key is not live.
+func (k *keydir) get(sum64 uint64) *KeyDirRecord {
+	s := k.shard(sum64)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.records[sum64]
+}
+
+// set points sum64 at record and returns the record it replaced.
+func (k *keydir) set(sum64 uint64, record *KeyDirRecord) *KeyDirRecord {
+	s := k.shard(sum64)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.records[sum64]
+	s.records[sum64] = record
+	return old
+}
+
+// remove drops sum64 and returns the record it had.
+func (k *keydir) remove(sum64 uint64) *KeyDirRecord {
+	s := k.shard(sum64)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.records[sum64]
+	delete(s.records, sum64)
+	return old
+}
+
+// removeIf drops every record matching fn.
+func (k *keydir) removeIf(fn func(*KeyDirRecord) bool) {
+	for i := range k.shards {
+		s := &k.shards[i]
+		s.mu.Lock()
+		for sum64, record := range s.records {
+			if fn(record) {
+				delete(s.records, sum64)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// each calls fn with every record, one shard at a time. fn runs with the
+// shard locked and must not change the keydir.
+func (k *keydir) each(fn func(uint64, *KeyDirRecord)) {
+	for i := range k.shards {
+		s := &k.shards[i]
+		s.mu.RLock()
+		for sum64, record := range s.records {
+			fn(sum64, record)
+		}
+		s.mu.RUnlock()
+	}
+}
+
+// len returns the number of live keys.
+func (k *keydir) len() int {
+	n := 0
+	for i := range k.shards {
+		s := &k.shards[i]
+		s.mu.RLock()
+		n += len(s.records)
+		s.mu.RUnlock()
+	}
+	return n
+}
@@ -0,0 +1,32 @@
+package flowdb
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestKeydir(t *testing.T) {
+	k := newKeydir()
+	for i := uint64(0); i < 200; i++ {
+		require.Nil(t, k.set(i, &KeyDirRecord{bucket: uint16(i % 2), ValueSize: uint32(i)}))
+	}
+	require.Equal(t, 200, k.len())
+	require.Equal(t, uint32(7), k.get(7).ValueSize)
+
+	old := k.set(7, &KeyDirRecord{ValueSize: 70})
+	require.Equal(t, uint32(7), old.ValueSize)
+	require.Equal(t, uint32(70), k.get(7).ValueSize)
+
+	require.Equal(t, uint32(70), k.remove(7).ValueSize)
+	require.Nil(t, k.get(7))
+	require.Nil(t, k.remove(7))
+
+	k.removeIf(func(record *KeyDirRecord) bool { return record.bucket == 1 })
+	require.Equal(t, 100, k.len())
+	seen := 0
+	k.each(func(sum64 uint64, record *KeyDirRecord) {
+		require.Equal(t, uint64(0), sum64%2)
+		seen++
+	})
+	require.Equal(t, 100, seen)
+}
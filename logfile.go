@@ -2,41 +2,127 @@ package flowdb
 
 import (
 	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 )
 
+// errCorruptHint reports a hint record that fails its CRC check
+var errCorruptHint = fmt.Errorf("%w: hint record", ErrCorrupt)
+
 type KeyDirRecord struct {
 	fileId    int64
+	bucket    uint16
 	ValueSize uint32
 	ValuePos  int64
 	Timestamp int64
 }
 
+// Hint locates an entry in its data file. ValueSize and Flags mirror the
+// entry header; v1 hints leave them zero. CRC covers the rest of the record
+// from v3 on.
 type Hint struct {
+	CRC       uint32
 	Timestamp uint64
 	ValuePos  uint64
 	Key       uint64
+	ValueSize uint32
+	Bucket    uint16
+	Flags     uint8
 }
 
-const hintHeaderSize = uint32(30)
+const (
+	hintHeaderSize   = uint32(35)
+	hintHeaderSizeV2 = uint32(31)
+	hintHeaderSizeV1 = uint32(30)
+)
 
 func EncodeHint(h *Hint) ([]byte, uint32) {
 	size := hintHeaderSize
 	buf := make([]byte, size)
 
+	// | CRC 4 | TS 8 | VPOS 8 | KEY 8 | VSIZE 4 | BKT 2 | FLAGS 1 |
+	binary.BigEndian.PutUint64(buf[4:12], h.Timestamp)
+	binary.BigEndian.PutUint64(buf[12:20], h.ValuePos)
+	binary.BigEndian.PutUint64(buf[20:28], h.Key)
+	binary.BigEndian.PutUint32(buf[28:32], h.ValueSize)
+	binary.BigEndian.PutUint16(buf[32:34], h.Bucket)
+	buf[34] = h.Flags
+
+	h.CRC = crc32.ChecksumIEEE(buf[4:])
+	binary.BigEndian.PutUint32(buf[:4], h.CRC)
+	return buf, size
+}
+
+// DecodeHint returns nil if the record fails its CRC check
+func DecodeHint(data []byte) *Hint {
+	if len(data) != int(hintHeaderSize) || binary.BigEndian.Uint32(data[:4]) != crc32.ChecksumIEEE(data[4:]) {
+		return nil
+	}
+
+	// | CRC 4 | TS 8 | VPOS 8 | KEY 8 | VSIZE 4 | BKT 2 | FLAGS 1 |
+	var hint Hint
+	hint.CRC = binary.BigEndian.Uint32(data[:4])
+	hint.Timestamp = binary.BigEndian.Uint64(data[4:12])
+	hint.ValuePos = binary.BigEndian.Uint64(data[12:20])
+	hint.Key = binary.BigEndian.Uint64(data[20:28])
+	hint.ValueSize = binary.BigEndian.Uint32(data[28:32])
+	hint.Bucket = binary.BigEndian.Uint16(data[32:34])
+	hint.Flags = data[34]
+
+	return &hint
+}
+
+// encodeHintV2 writes the v2 layout, which has no CRC.
+func encodeHintV2(h *Hint) ([]byte, uint32) {
+	size := hintHeaderSizeV2
+	buf := make([]byte, size)
+
+	// | TS 8 | VPOS 8 | KEY 8 | VSIZE 4 | BKT 2 | FLAGS 1 |
+	binary.BigEndian.PutUint64(buf[:8], h.Timestamp)
+	binary.BigEndian.PutUint64(buf[8:16], h.ValuePos)
+	binary.BigEndian.PutUint64(buf[16:24], h.Key)
+	binary.BigEndian.PutUint32(buf[24:28], h.ValueSize)
+	binary.BigEndian.PutUint16(buf[28:30], h.Bucket)
+	buf[30] = h.Flags
+
+	return buf, size
+}
+
+func decodeHintV2(data []byte) *Hint {
+	// | TS 8 | VPOS 8 | KEY 8 | VSIZE 4 | BKT 2 | FLAGS 1 |
+	var hint Hint
+	hint.Timestamp = binary.BigEndian.Uint64(data[:8])
+	hint.ValuePos = binary.BigEndian.Uint64(data[8:16])
+	hint.Key = binary.BigEndian.Uint64(data[16:24])
+	hint.ValueSize = binary.BigEndian.Uint32(data[24:28])
+	hint.Bucket = binary.BigEndian.Uint16(data[28:30])
+	hint.Flags = data[30]
+
+	return &hint
+}
+
+// encodeHintV1 writes the headerless v1 layout, which has the bucket id in
+// the spare bytes of the TS window and no entry size.
+func encodeHintV1(h *Hint) ([]byte, uint32) {
+	size := hintHeaderSizeV1
+	buf := make([]byte, size)
+
 	// | TS 10  | VPOS 10  | KEY 10 |
 	binary.BigEndian.PutUint64(buf[:10], h.Timestamp)
+	binary.BigEndian.PutUint16(buf[8:10], h.Bucket)
 	binary.BigEndian.PutUint64(buf[10:20], h.ValuePos)
 	binary.BigEndian.PutUint64(buf[20:30], h.Key)
 
 	return buf, size
 }
 
-func DecodeHint(data []byte) *Hint {
+func decodeHintV1(data []byte) *Hint {
 	// | TS 10  | VPOS 10  | KEY 10 |
 	var hint Hint
-	hint.Timestamp = binary.BigEndian.Uint64(data[:10])
-	hint.ValuePos = binary.BigEndian.Uint64(data[10:20])
-	hint.Key = binary.BigEndian.Uint64(data[20:30])
+	hint.Timestamp = binary.BigEndian.Uint64(data[:8])
+	hint.Bucket = binary.BigEndian.Uint16(data[8:10])
+	hint.ValuePos = binary.BigEndian.Uint64(data[10:18])
+	hint.Key = binary.BigEndian.Uint64(data[20:28])
 
 	return &hint
 }
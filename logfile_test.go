@@ -11,8 +11,43 @@ func TestHint(t *testing.T) {
 		Timestamp: uint64(time.Now().UnixMicro()),
 		ValuePos:  100,
 		Key:       Hash([]byte("test")),
+		ValueSize: 32,
+		Bucket:    2,
+		Flags:     flagTombstone,
 	}
 	data, _ := EncodeHint(&hint)
 	expect := DecodeHint(data)
 	require.Equal(t, expect, &hint)
 }
+
+func TestHintV1(t *testing.T) {
+	hint := Hint{
+		Timestamp: uint64(time.Now().UnixMicro()),
+		ValuePos:  100,
+		Key:       Hash([]byte("test")),
+		Bucket:    2,
+	}
+	data, _ := encodeHintV1(&hint)
+	expect := decodeHintV1(data)
+	require.Equal(t, expect, &hint)
+}
+
+func TestHintCorrupt(t *testing.T) {
+	data, _ := EncodeHint(&Hint{Timestamp: 1, ValuePos: 8, Key: Hash([]byte("test"))})
+	data[10] ^= 0xff
+	require.Nil(t, DecodeHint(data))
+}
+
+func TestHintV2(t *testing.T) {
+	hint := Hint{
+		Timestamp: uint64(time.Now().UnixMicro()),
+		ValuePos:  100,
+		Key:       Hash([]byte("test")),
+		ValueSize: 32,
+		Bucket:    2,
+		Flags:     flagTombstone,
+	}
+	data, _ := encodeHintV2(&hint)
+	expect := decodeHintV2(data)
+	require.Equal(t, expect, &hint)
+}
@@ -0,0 +1,163 @@
+package flowdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+)
+
+const manifestFileName = "manifest.json"
+
+// Placement decides which of Options.DataDirectories a new data file goes to
+type Placement int
+
+const (
+	// PlaceRoundRobin takes the directories in turn
+	PlaceRoundRobin Placement = iota
+	// PlaceFreeSpace takes the directory with the most free space, falling
+	// back to round robin where the file system cannot tell
+	PlaceFreeSpace
+)
+
+// manifest records the data files living outside the database directory.
+// Files it does not list are in the database directory itself.
+type manifest struct {
+	Files map[int64]string `json:"files"`
+}
+
+// freeSpacer is implemented by file systems that know how much space is
+// left under a directory
+type freeSpacer interface {
+	FreeSpace(dir string) (int64, error)
+}
+
+// fileDir returns the directory holding data file id and its hint file.
+func (f *FlowDB) fileDir(id int64) string {
+	f.filesMu.RLock()
+	defer f.filesMu.RUnlock()
+
+	if dir, ok := f.manifest.Files[id]; ok {
+		return dir
+	}
+	return f.options.DatabaseDirectory
+}
+
+// fileIds returns the sorted ids of the files of kind, data or hint, in the
+// database directory and every directory of the manifest.
+func (f *FlowDB) fileIds(kind string) []int64 {
+	dirs := map[string]bool{f.options.DatabaseDirectory: true}
+	f.filesMu.RLock()
+	for _, dir := range f.manifest.Files {
+		dirs[dir] = true
+	}
+	f.filesMu.RUnlock()
+
+	var ids []int64
+	for dir := range dirs {
+		for _, id := range listFileIds(f.options.FS, path.Join(dir, kind), "."+kind) {
+			if f.fileDir(id) == dir {
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// placeFile picks the directory of new data file id and records it in the
+// manifest before the file is created, so recovery always finds it. The
+// caller must hold f.writeMu or f.mu exclusively.
+func (f *FlowDB) placeFile(id int64) error {
+	dirs := f.options.DataDirectories
+	if len(dirs) == 0 {
+		return nil
+	}
+	dir := dirs[int(id%int64(len(dirs)))]
+	if spacer, ok := f.options.FS.(freeSpacer); ok && f.options.Placement == PlaceFreeSpace {
+		best := int64(-1)
+		for _, candidate := range dirs {
+			free, err := spacer.FreeSpace(candidate)
+			if err != nil {
+				best = -1
+				break
+			}
+			if free > best {
+				dir, best = candidate, free
+			}
+		}
+		if best < 0 {
+			dir = dirs[int(id%int64(len(dirs)))]
+		}
+	}
+	if path.Clean(dir) == path.Clean(f.options.DatabaseDirectory) {
+		return nil
+	}
+	return f.moveFile(id, dir)
+}
+
+// moveFile records in the manifest that data file id lives in dir. The
+// caller must hold f.writeMu or f.mu exclusively, which keeps saves in
+// order.
+func (f *FlowDB) moveFile(id int64, dir string) error {
+	f.filesMu.Lock()
+	f.manifest.Files[id] = dir
+	f.filesMu.Unlock()
+	return f.saveManifest()
+}
+
+// forgetFiles drops ids from the manifest once their files are gone. The
+// caller must hold f.writeMu or f.mu exclusively.
+func (f *FlowDB) forgetFiles(ids []int64) error {
+	f.filesMu.Lock()
+	changed := false
+	for _, id := range ids {
+		if _, ok := f.manifest.Files[id]; ok {
+			delete(f.manifest.Files, id)
+			changed = true
+		}
+	}
+	f.filesMu.Unlock()
+	if !changed {
+		return nil
+	}
+	return f.saveManifest()
+}
+
+func (f *FlowDB) loadManifest() error {
+	data, err := readFile(f.options.FS, path.Join(f.options.DatabaseDirectory, manifestFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	m := manifest{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("%s: %v", manifestFileName, err)
+	}
+	if m.Files == nil {
+		m.Files = make(map[int64]string)
+	}
+	f.filesMu.Lock()
+	f.manifest = m
+	f.filesMu.Unlock()
+	return nil
+}
+
+// saveManifest writes the manifest through a temporary file like
+// saveBuckets.
+func (f *FlowDB) saveManifest() error {
+	f.filesMu.RLock()
+	data, err := json.Marshal(f.manifest)
+	f.filesMu.RUnlock()
+	if err != nil {
+		return err
+	}
+	file := path.Join(f.options.DatabaseDirectory, manifestFileName)
+	if err := writeFile(f.options.FS, file+".tmp", data, FM); err != nil {
+		return err
+	}
+	return f.options.FS.Rename(file+".tmp", file)
+}
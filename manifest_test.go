@@ -0,0 +1,67 @@
+package flowdb
+
+import (
+	"github.com/stretchr/testify/require"
+	"path"
+	"testing"
+)
+
+func TestDataDirectories(t *testing.T) {
+	options := DefaultOptions("db")
+	options.FS = NewMemFS()
+	options.DataDirectories = []string{"disk1/db", "disk2/db"}
+	db := NewWithOptions(options)
+	require.NoError(t, db.Load())
+	require.NoError(t, db.Put([]byte("a"), []byte("1")))
+	require.NoError(t, db.Merge())
+	require.NoError(t, db.Put([]byte("b"), []byte("2")))
+	require.NoError(t, db.Merge())
+	require.NoError(t, db.Close())
+
+	// file 1 went to disk2, merged into 2 on disk1, then into 3 on disk2
+	require.Equal(t, map[int64]string{3: "disk2/db"}, db.manifest.Files)
+	_, err := options.FS.Stat(path.Join("disk2/db", "data", "3.data"))
+	require.NoError(t, err)
+	_, err = options.FS.Stat(path.Join("disk1/db", "data", "2.data"))
+	require.Error(t, err)
+
+	// the manifest alone is enough to find the files
+	report, err := NewWithOptions(Options{DatabaseDirectory: "db", FS: options.FS}).fsck()
+	require.NoError(t, err)
+	require.True(t, report.OK())
+	require.Equal(t, 2, report.Keys)
+
+	db = NewWithOptions(options)
+	require.NoError(t, db.Load())
+	for key, want := range map[string]string{"a": "1", "b": "2"} {
+		value, err := db.Get([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, []byte(want), value)
+	}
+	require.NoError(t, db.Close())
+}
+
+type freeSpaceFS struct {
+	*MemFS
+	free map[string]int64
+}
+
+func (fs freeSpaceFS) FreeSpace(dir string) (int64, error) {
+	return fs.free[dir], nil
+}
+
+func TestPlaceFreeSpace(t *testing.T) {
+	fs := freeSpaceFS{MemFS: NewMemFS(), free: map[string]int64{"disk1": 10, "disk2": 20, "disk3": 5}}
+	options := DefaultOptions("db")
+	options.FS = fs
+	options.DataDirectories = []string{"disk1", "disk2", "disk3"}
+	options.Placement = PlaceFreeSpace
+	db := NewWithOptions(options)
+	require.NoError(t, db.Load())
+	require.Equal(t, "disk2", db.fileDir(1))
+
+	fs.free["disk3"] = 30
+	require.NoError(t, db.Merge())
+	require.Equal(t, "disk3", db.fileDir(2))
+	require.NoError(t, db.Close())
+}
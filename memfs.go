@@ -0,0 +1,376 @@
+package flowdb
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrCrashed is returned by every call on a file opened before a simulated
+// crash, and by a FaultFS after it crashed
+var ErrCrashed = errors.New("file system crashed")
+
+// MemFS is an FS held in memory. Sync marks what a simulated Crash keeps;
+// directory changes such as creating, renaming and removing files take effect
+// at once and survive a crash.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memNode
+	dirs  map[string]bool
+	// generation is bumped by Crash so older handles stop working
+	generation int
+}
+
+type memNode struct {
+	data    []byte
+	synced  []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// NewMemFS returns an empty in-memory file system
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memNode),
+		dirs:  map[string]bool{"/": true, ".": true},
+	}
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = path.Clean(name)
+	node, ok := m.files[name]
+	switch {
+	case m.dirs[name]:
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !ok:
+		if !m.dirs[path.Dir(name)] {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		node = &memNode{mode: perm, modTime: time.Now()}
+		m.files[name] = node
+	}
+	if flag&os.O_TRUNC != 0 {
+		node.data = nil
+	}
+	return &memFile{fs: m, name: name, node: node, flag: flag, generation: m.generation}, nil
+}
+
+func (m *MemFS) ReadDir(dir string) ([]os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir = path.Clean(dir)
+	if !m.dirs[dir] {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: os.ErrNotExist}
+	}
+	var infos []os.FileInfo
+	for name, node := range m.files {
+		if path.Dir(name) == dir {
+			infos = append(infos, &memFileInfo{name: path.Base(name), size: int64(len(node.data)), mode: node.mode, modTime: node.modTime})
+		}
+	}
+	for name := range m.dirs {
+		if name != dir && path.Dir(name) == dir {
+			infos = append(infos, &memFileInfo{name: path.Base(name), mode: os.ModeDir | 0750})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (m *MemFS) MkdirAll(dir string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for dir = path.Clean(dir); !m.dirs[dir]; dir = path.Dir(dir) {
+		if _, ok := m.files[dir]; ok {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: errors.New("not a directory")}
+		}
+		m.dirs[dir] = true
+	}
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = path.Clean(name)
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if !m.dirs[name] {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	for other := range m.files {
+		if path.Dir(other) == name {
+			return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+		}
+	}
+	for other := range m.dirs {
+		if other != name && path.Dir(other) == name {
+			return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+		}
+	}
+	delete(m.dirs, name)
+	return nil
+}
+
+func (m *MemFS) RemoveAll(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = path.Clean(name)
+	delete(m.files, name)
+	delete(m.dirs, name)
+	for other := range m.files {
+		if strings.HasPrefix(other, name+"/") {
+			delete(m.files, other)
+		}
+	}
+	for other := range m.dirs {
+		if strings.HasPrefix(other, name+"/") {
+			delete(m.dirs, other)
+		}
+	}
+	return nil
+}
+
+func (m *MemFS) Rename(oldName, newName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldName, newName = path.Clean(oldName), path.Clean(newName)
+	if !m.dirs[path.Dir(newName)] {
+		return &os.PathError{Op: "rename", Path: newName, Err: os.ErrNotExist}
+	}
+	if node, ok := m.files[oldName]; ok {
+		if m.dirs[newName] {
+			return &os.PathError{Op: "rename", Path: newName, Err: errors.New("is a directory")}
+		}
+		delete(m.files, oldName)
+		m.files[newName] = node
+		return nil
+	}
+	if !m.dirs[oldName] {
+		return &os.PathError{Op: "rename", Path: oldName, Err: os.ErrNotExist}
+	}
+	if _, ok := m.files[newName]; ok || m.dirs[newName] {
+		return &os.PathError{Op: "rename", Path: newName, Err: os.ErrExist}
+	}
+	for name, node := range m.files {
+		if strings.HasPrefix(name, oldName+"/") {
+			delete(m.files, name)
+			m.files[newName+name[len(oldName):]] = node
+		}
+	}
+	for name := range m.dirs {
+		if name == oldName || strings.HasPrefix(name, oldName+"/") {
+			delete(m.dirs, name)
+			m.dirs[newName+name[len(oldName):]] = true
+		}
+	}
+	return nil
+}
+
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = path.Clean(name)
+	if node, ok := m.files[name]; ok {
+		return &memFileInfo{name: path.Base(name), size: int64(len(node.data)), mode: node.mode, modTime: node.modTime}, nil
+	}
+	if m.dirs[name] {
+		return &memFileInfo{name: path.Base(name), mode: os.ModeDir | 0750}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+// Crash simulates losing power: every file falls back to what it held at its
+// last Sync, and files opened before the crash stop working.
+func (m *MemFS) Crash() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, node := range m.files {
+		node.data = append([]byte(nil), node.synced...)
+	}
+	m.generation++
+}
+
+type memFile struct {
+	fs         *MemFS
+	name       string
+	node       *memNode
+	flag       int
+	offset     int64
+	closed     bool
+	generation int
+}
+
+// check returns why the file cannot be used. The caller must hold fs.mu.
+func (f *memFile) check() error {
+	if f.generation != f.fs.generation {
+		return ErrCrashed
+	}
+	if f.closed {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	if f.offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: errors.New("bad file descriptor")}
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.node.data))
+	}
+	if gap := f.offset - int64(len(f.node.data)); gap > 0 {
+		f.node.data = append(f.node.data, make([]byte, gap)...)
+	}
+	n := copy(f.node.data[f.offset:], p)
+	f.node.data = append(f.node.data, p[n:]...)
+	f.offset += int64(len(p))
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: errors.New("invalid argument")}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check(); err != nil {
+		return err
+	}
+	f.node.synced = append(f.node.synced[:0], f.node.data...)
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check(); err != nil {
+		return err
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: errors.New("bad file descriptor")}
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: errors.New("invalid argument")}
+	}
+	if gap := size - int64(len(f.node.data)); gap > 0 {
+		f.node.data = append(f.node.data, make([]byte, gap)...)
+	}
+	f.node.data = f.node.data[:size]
+	f.node.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	return &memFileInfo{name: path.Base(f.name), size: int64(len(f.node.data)), mode: f.node.mode, modTime: f.node.modTime}, nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check(); err != nil {
+		return err
+	}
+	f.closed = true
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i *memFileInfo) Name() string       { return i.name }
+func (i *memFileInfo) Size() int64        { return i.size }
+func (i *memFileInfo) Mode() os.FileMode  { return i.mode }
+func (i *memFileInfo) ModTime() time.Time { return i.modTime }
+func (i *memFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,72 @@
+package flowdb
+
+import (
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestMemFS(t *testing.T) {
+	fs := NewMemFS()
+	_, err := fs.OpenFile("db/a", os.O_RDWR|os.O_CREATE, FM)
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, fs.MkdirAll("db/data", FM))
+
+	fd, err := fs.OpenFile("db/data/a", FFlag, FM)
+	require.NoError(t, err)
+	_, err = fd.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 3)
+	_, err = fd.ReadAt(buf, 2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("llo"), buf)
+	offset, err := fd.Seek(0, io.SeekEnd)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), offset)
+
+	infos, err := fs.ReadDir("db")
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	require.True(t, infos[0].IsDir())
+
+	require.NoError(t, fs.Rename("db", "db2"))
+	data, err := readFile(fs, "db2/data/a")
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello"), data)
+
+	// only synced bytes survive a crash
+	require.NoError(t, fd.Sync())
+	_, err = fd.Write([]byte(" world"))
+	require.NoError(t, err)
+	fs.Crash()
+	_, err = fd.Write([]byte("!"))
+	require.Equal(t, ErrCrashed, err)
+	data, err = readFile(fs, "db2/data/a")
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello"), data)
+}
+
+func TestFlowDBOnMemFS(t *testing.T) {
+	fs := NewMemFS()
+	options := DefaultOptions("db")
+	options.FS = fs
+	db := NewWithOptions(options)
+	require.NoError(t, db.Load())
+	require.NoError(t, db.Put([]byte("a"), []byte("1")))
+	require.NoError(t, db.Sync())
+	require.NoError(t, db.Put([]byte("b"), []byte("2")))
+
+	_, err := os.Stat("db")
+	require.True(t, os.IsNotExist(err))
+
+	fs.Crash()
+	db = NewWithOptions(options)
+	require.NoError(t, db.Load())
+	value, err := db.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), value)
+	_, err = db.Get([]byte("b"))
+	require.Error(t, err)
+	require.NoError(t, db.Close())
+}
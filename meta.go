@@ -0,0 +1,78 @@
+package flowdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+)
+
+const metaFileName = "meta.json"
+
+// dirMeta records how the files of a database directory were written
+type dirMeta struct {
+	Hasher string `json:"hasher"`
+}
+
+// checkMeta makes sure the directory is opened with the hasher it was
+// written with, recording the hasher on first use. Directories from before
+// the record existed were always written with FNV-1a.
+func (f *FlowDB) checkMeta() error {
+	meta, err := f.loadMeta()
+	if err != nil {
+		return err
+	}
+	if meta.Hasher == "" {
+		meta.Hasher = f.options.Hasher.Name()
+		if len(f.dataFileIds()) > 0 {
+			meta.Hasher = FNV1a.Name()
+		}
+		if err := f.saveMeta(meta); err != nil {
+			return err
+		}
+	}
+	if meta.Hasher != f.options.Hasher.Name() {
+		return fmt.Errorf("database was written with hasher %s, not %s", meta.Hasher, f.options.Hasher.Name())
+	}
+	return nil
+}
+
+// useRecordedHasher switches to the hasher the directory was written with,
+// for tools that open a directory without knowing it.
+func (f *FlowDB) useRecordedHasher() error {
+	meta, err := f.loadMeta()
+	if err != nil || meta.Hasher == "" || meta.Hasher == f.options.Hasher.Name() {
+		return err
+	}
+	h, ok := hashers[meta.Hasher]
+	if !ok {
+		return fmt.Errorf("unknown hasher %s", meta.Hasher)
+	}
+	f.options.Hasher = h
+	return nil
+}
+
+func (f *FlowDB) loadMeta() (dirMeta, error) {
+	var meta dirMeta
+	data, err := readFile(f.options.FS, path.Join(f.options.DatabaseDirectory, metaFileName))
+	if os.IsNotExist(err) {
+		return meta, nil
+	}
+	if err != nil {
+		return meta, err
+	}
+	return meta, json.Unmarshal(data, &meta)
+}
+
+// saveMeta writes the record through a temporary file like saveBuckets.
+func (f *FlowDB) saveMeta(meta dirMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	file := path.Join(f.options.DatabaseDirectory, metaFileName)
+	if err := writeFile(f.options.FS, file+".tmp", data, FM); err != nil {
+		return err
+	}
+	return f.options.FS.Rename(file+".tmp", file)
+}
@@ -0,0 +1,53 @@
+package flowdb
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestHasherRecorded(t *testing.T) {
+	dir := t.TempDir()
+	options := DefaultOptions(dir)
+	options.Hasher = XXHash64
+	db := NewWithOptions(options)
+	require.NoError(t, db.Load())
+	require.NoError(t, db.Put([]byte("a"), []byte("1")))
+	require.NoError(t, db.Close())
+
+	require.Error(t, New(dir).Load())
+
+	db = NewWithOptions(options)
+	require.NoError(t, db.Load())
+	value, err := db.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), value)
+	require.NoError(t, db.Close())
+
+	// offline tools pick the recorded hasher up on their own
+	report, err := Fsck(dir)
+	require.NoError(t, err)
+	require.True(t, report.OK())
+	require.Equal(t, 1, report.Keys)
+}
+
+func TestHasherLegacyDirectory(t *testing.T) {
+	dir := t.TempDir()
+	db := New(dir)
+	require.NoError(t, db.Load())
+	require.NoError(t, db.Put([]byte("a"), []byte("1")))
+	require.NoError(t, db.Close())
+	require.NoError(t, os.Remove(path.Join(dir, metaFileName)))
+
+	options := DefaultOptions(dir)
+	options.Hasher = XXHash64
+	require.Error(t, NewWithOptions(options).Load())
+
+	db = New(dir)
+	require.NoError(t, db.Load())
+	meta, err := db.loadMeta()
+	require.NoError(t, err)
+	require.Equal(t, FNV1a.Name(), meta.Hasher)
+	require.NoError(t, db.Close())
+}
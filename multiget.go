@@ -0,0 +1,99 @@
+package flowdb
+
+import "sort"
+
+const (
+	// multiGetGap is how many unwanted bytes MultiGet reads at most to serve
+	// two entries of a file with a single read
+	multiGetGap = 4 << 10
+	// multiGetSpan caps the bytes a single read of MultiGet covers
+	multiGetSpan = 1 << 20
+)
+
+// MultiGet looks up all of keys and returns their values and errors in the
+// order of keys, the error for a key being the one Get would return. The
+// keys are resolved under one read lock and read in file order, entries
+// close to each other sharing a single read.
+func (f *FlowDB) MultiGet(keys [][]byte) ([][]byte, []error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.multiGet(defaultBucket, keys)
+}
+
+// multiGet does the work of MultiGet for bucket. The caller must hold f.mu.
+func (f *FlowDB) multiGet(bucket uint16, keys [][]byte) ([][]byte, []error) {
+	values := make([][]byte, len(keys))
+	errs := make([]error, len(keys))
+
+	type read struct {
+		index  int
+		record *KeyDirRecord
+	}
+	reads := make([]read, 0, len(keys))
+	for i, key := range keys {
+		record := f.keydir.get(f.keyHash(bucket, key))
+		if record == nil {
+			errs[i] = ErrKeyNotFound
+			continue
+		}
+		reads = append(reads, read{index: i, record: record})
+	}
+	sort.Slice(reads, func(i, j int) bool {
+		if reads[i].record.fileId != reads[j].record.fileId {
+			return reads[i].record.fileId < reads[j].record.fileId
+		}
+		return reads[i].record.ValuePos < reads[j].record.ValuePos
+	})
+
+	for start := 0; start < len(reads); {
+		first := reads[start].record
+		end := first.ValuePos + int64(first.ValueSize)
+		next := start + 1
+		for ; next < len(reads); next++ {
+			record := reads[next].record
+			recordEnd := record.ValuePos + int64(record.ValueSize)
+			if record.fileId != first.fileId || record.ValuePos > end+multiGetGap || recordEnd-first.ValuePos > multiGetSpan {
+				break
+			}
+			if recordEnd > end {
+				end = recordEnd
+			}
+		}
+
+		buf, version, err := f.readSpan(first.fileId, first.ValuePos, end)
+		for _, r := range reads[start:next] {
+			if err != nil {
+				errs[r.index] = err
+				continue
+			}
+			offset := r.record.ValuePos - first.ValuePos
+			entry := decodeEntryVersion(version, buf[offset:offset+int64(r.record.ValueSize)])
+			switch {
+			case entry == nil:
+				errs[r.index] = ErrCorrupt
+			case !entry.is(bucket, keys[r.index]):
+				errs[r.index] = ErrKeyNotFound
+			case entry.Type != TypeString:
+				errs[r.index] = ErrWrongType
+			default:
+				values[r.index] = entry.Value
+			}
+		}
+		start = next
+	}
+	return values, errs
+}
+
+// readSpan reads the bytes between start and end of a data file at once.
+func (f *FlowDB) readSpan(fileId, start, end int64) ([]byte, uint16, error) {
+	fd, version, ok := f.dataFile(fileId)
+	if !ok {
+		return nil, 0, ErrCorrupt
+	}
+	buf := make([]byte, end-start)
+	if _, err := fd.ReadAt(buf, start); err != nil {
+		return nil, 0, err
+	}
+	return buf, version, nil
+}
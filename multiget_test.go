@@ -0,0 +1,47 @@
+package flowdb
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"math"
+	"testing"
+)
+
+func TestMultiGet(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+	options := DefaultOptions("db")
+	options.FS = fs
+	db := ingestedDB(t, options)
+	require.NoError(t, db.Put([]byte("k:007"), []byte("new")))
+	_, err := db.LPush([]byte("list"), []byte("a"))
+	require.NoError(t, err)
+
+	keys := [][]byte{[]byte("k:049"), []byte("missing"), []byte("k:007"), []byte("list"), []byte("k:000"), []byte("k:049")}
+	values, errs := db.MultiGet(keys)
+	require.Len(t, values, len(keys))
+	require.Len(t, errs, len(keys))
+	for i, key := range keys {
+		value, err := db.Get(key)
+		require.Equal(t, err, errs[i], "key %s", key)
+		require.Equal(t, value, values[i], "key %s", key)
+	}
+	require.Equal(t, []byte("v49"), values[0])
+	require.Equal(t, []byte("new"), values[2])
+
+	// one read per file when every key of it is asked for
+	all := make([][]byte, 50)
+	files := make(map[int64]bool)
+	for i := range all {
+		all[i] = []byte(fmt.Sprintf("k:%03d", 49-i))
+		files[db.keydir.get(db.keyHash(defaultBucket, all[i])).fileId] = true
+	}
+	fs.Inject(Fault{Op: "read", Path: "db/data/*.data", After: math.MaxInt32})
+	values, errs = db.MultiGet(all)
+	require.Equal(t, len(files), fs.Seen(0))
+	for i := range all {
+		require.NoError(t, errs[i])
+	}
+	require.Equal(t, []byte("v49"), values[0])
+	require.Equal(t, []byte("new"), values[42])
+	require.NoError(t, db.Close())
+}
@@ -0,0 +1,29 @@
+package flowdb
+
+import (
+	"errors"
+	"syscall"
+)
+
+// fallocKeepSize reserves blocks without moving the end of the file, so
+// appends still land right after the last entry
+const fallocKeepSize = 0x1
+
+// preallocate reserves size bytes of disk for fd up front, so the file does
+// not get its blocks piecemeal while it is being appended to, and returns
+// how much it reserved. Files that are not backed by the operating system,
+// and file systems that cannot preallocate, are left alone.
+func preallocate(fd File, size int64) (int64, error) {
+	osFile, ok := fd.(interface{ Fd() uintptr })
+	if !ok {
+		return 0, nil
+	}
+	err := syscall.Fallocate(int(osFile.Fd()), fallocKeepSize, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package flowdb
+
+// preallocate is a no-op where fallocate is not available.
+func preallocate(fd File, size int64) (int64, error) {
+	return 0, nil
+}
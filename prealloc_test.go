@@ -0,0 +1,119 @@
+package flowdb
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestPreallocate(t *testing.T) {
+	options := DefaultOptions(path.Join(t.TempDir(), "db"))
+	require.Zero(t, options.PreallocateSize)
+	options.PreallocateSize = 1 << 20
+	db := NewWithOptions(options)
+	require.NoError(t, db.Load())
+	require.NoError(t, db.Put([]byte("a"), []byte("1")))
+
+	// the reserved space does not show up as file size, but as disk usage
+	info, err := os.Stat(db.dataFilePath(1))
+	require.NoError(t, err)
+	require.Equal(t, db.activeFileOffset, info.Size())
+	require.Equal(t, options.PreallocateSize+db.activeHintOffset, db.DiskUsage())
+	require.NoError(t, db.Close())
+
+	db = NewWithOptions(options)
+	require.NoError(t, db.Load())
+	value, err := db.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), value)
+	require.Equal(t, options.PreallocateSize+db.activeHintOffset, db.DiskUsage())
+	require.NoError(t, db.Put([]byte("b"), []byte("2")))
+	require.Equal(t, options.PreallocateSize+db.activeHintOffset, db.DiskUsage())
+
+	// a rotation gives the rest back and reserves for the next file
+	db.mu.Lock()
+	require.NoError(t, db.rotateActiveFile())
+	tracked := db.diskUsage
+	require.NoError(t, db.measureDiskUsage())
+	require.Equal(t, db.diskUsage, tracked)
+	db.mu.Unlock()
+	require.NoError(t, db.Close())
+}
+
+func TestRecoverTrimsTail(t *testing.T) {
+	options := DefaultOptions("db")
+	options.FS = NewMemFS()
+	db := NewWithOptions(options)
+	require.NoError(t, db.Load())
+	require.NoError(t, db.Put([]byte("a"), []byte("1")))
+	require.NoError(t, db.Close())
+
+	// zeroed space and half a hint record, as a crash can leave behind
+	for file, tail := range map[string][]byte{db.dataFilePath(1): make([]byte, 4096), db.hintFilePath(1): make([]byte, 7)} {
+		fd, err := options.FS.OpenFile(file, FFlag, FM)
+		require.NoError(t, err)
+		_, err = fd.Write(tail)
+		require.NoError(t, err)
+		require.NoError(t, fd.Close())
+	}
+
+	db = NewWithOptions(options)
+	require.NoError(t, db.Load())
+	require.NoError(t, db.Put([]byte("b"), []byte("2")))
+	require.NoError(t, db.Close())
+
+	report, err := NewWithOptions(options).fsck()
+	require.NoError(t, err)
+	require.True(t, report.OK())
+	db = NewWithOptions(options)
+	require.NoError(t, db.Load())
+	for key, want := range map[string]string{"a": "1", "b": "2"} {
+		value, err := db.Get([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, []byte(want), value)
+	}
+	require.NoError(t, db.Close())
+}
+
+func TestRecoverUntrustedHints(t *testing.T) {
+	options := DefaultOptions("db")
+	options.FS = NewMemFS()
+	db := NewWithOptions(options)
+	require.NoError(t, db.Load())
+	require.NoError(t, db.Put([]byte("a"), []byte("1")))
+	db.mu.Lock()
+	require.NoError(t, db.rotateActiveFile())
+	db.mu.Unlock()
+	require.NoError(t, db.Put([]byte("b"), []byte("2")))
+	require.NoError(t, db.Put([]byte("c"), []byte("3")))
+	require.NoError(t, db.Close())
+
+	// an older file without its hint file, the latest with the hint of "c"
+	// lost and then with no hint file at all
+	require.NoError(t, options.FS.Remove(db.hintFilePath(1)))
+	fd, err := options.FS.OpenFile(db.hintFilePath(2), os.O_RDWR, FM)
+	require.NoError(t, err)
+	require.NoError(t, fd.Truncate(int64(fileHeaderSize+hintHeaderSize)))
+	require.NoError(t, fd.Close())
+	for i := 0; i < 2; i++ {
+		db = NewWithOptions(options)
+		require.NoError(t, db.Load())
+		for key, want := range map[string]string{"a": "1", "b": "2", "c": "3"} {
+			value, err := db.Get([]byte(key))
+			require.NoError(t, err)
+			require.Equal(t, []byte(want), value)
+		}
+		require.NoError(t, db.Close())
+		require.NoError(t, options.FS.Remove(db.hintFilePath(2)))
+	}
+
+	db = NewWithOptions(options)
+	require.NoError(t, db.Load())
+	require.NoError(t, db.Put([]byte("d"), []byte("4")))
+	require.NoError(t, db.Close())
+	report, err := NewWithOptions(options).fsck()
+	require.NoError(t, err)
+	require.Equal(t, 4, report.Keys)
+	require.Len(t, report.Files, 2)
+}
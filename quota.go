@@ -0,0 +1,115 @@
+package flowdb
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// ErrDiskFull is returned by writes once the database has run out of space,
+// either on the disk or under Options.DiskQuota
+var ErrDiskFull = errors.New("disk full")
+
+// ReadOnly reports whether the database stopped taking writes after running
+// out of space. Reads keep working; a Merge that frees space ends it.
+func (f *FlowDB) ReadOnly() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	return f.readOnly
+}
+
+// DiskUsage returns the bytes taken by the data and hint files, the figure
+// Options.DiskQuota is checked against.
+func (f *FlowDB) DiskUsage() int64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	return f.diskUsage
+}
+
+// checkSpace fails with ErrDiskFull if appending size bytes of data and a
+// hint would not fit, and switches the database to read only when it does.
+// The caller must hold f.writeMu or f.mu exclusively.
+func (f *FlowDB) checkSpace(size uint32) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	if f.readOnly {
+		return ErrDiskFull
+	}
+	quota := f.options.DiskQuota
+	if quota > 0 && f.diskUsage+f.dataGrowth(f.activeFileOffset+int64(size))+int64(hintHeaderSize) > quota {
+		f.readOnly = true
+		return ErrDiskFull
+	}
+	return nil
+}
+
+// spaceError turns a failed write into ErrDiskFull, switching the database
+// to read only, if the file system ran out of space.
+func (f *FlowDB) spaceError(err error) error {
+	if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) {
+		f.readOnly = true
+		return ErrDiskFull
+	}
+	return err
+}
+
+// measureDiskUsage sums up the sizes of the data and hint files, wherever
+// they live, and the space reserved for the active file past its end. The
+// caller must hold f.writeMu or f.mu exclusively.
+func (f *FlowDB) measureDiskUsage() error {
+	var usage int64
+	for _, id := range f.dataFileIds() {
+		for _, file := range []string{f.dataFilePath(id), f.hintFilePath(id)} {
+			info, err := f.options.FS.Stat(file)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			usage += info.Size()
+		}
+	}
+	f.diskUsage = usage + f.reservation()
+	return nil
+}
+
+// reservation returns the preallocated space of the active file that no
+// entry has taken yet. The caller must hold f.writeMu or f.mu exclusively.
+func (f *FlowDB) reservation() int64 {
+	if f.activeReserve > f.activeFileOffset {
+		return f.activeReserve - f.activeFileOffset
+	}
+	return 0
+}
+
+// dataGrowth returns how much more disk the active file takes once it is
+// written up to end, the reserved space being taken already. The caller
+// must hold f.writeMu or f.mu exclusively.
+func (f *FlowDB) dataGrowth(end int64) int64 {
+	taken := f.activeFileOffset
+	if f.activeReserve > taken {
+		taken = f.activeReserve
+	}
+	if end > taken {
+		return end - taken
+	}
+	return 0
+}
+
+// endReadOnly lets writes in again after Merge, unless the files are still
+// over the quota. Without a quota the next write finds out whether the disk
+// has room.
+func (f *FlowDB) endReadOnly() {
+	quota := f.options.DiskQuota
+	if quota <= 0 || f.diskUsage < quota {
+		f.readOnly = false
+	}
+}
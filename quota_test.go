@@ -0,0 +1,114 @@
+package flowdb
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestDiskQuota(t *testing.T) {
+	options := DefaultOptions("db")
+	options.FS = NewMemFS()
+	options.DiskQuota = 4096
+	db := NewWithOptions(options)
+	require.NoError(t, db.Load())
+
+	var err error
+	written := 0
+	for ; written < 1000; written++ {
+		if err = db.Put([]byte("k"), []byte(strconv.Itoa(written))); err != nil {
+			break
+		}
+	}
+	require.Equal(t, ErrDiskFull, err)
+	require.True(t, db.ReadOnly())
+	require.LessOrEqual(t, db.DiskUsage(), options.DiskQuota)
+	require.Equal(t, ErrDiskFull, db.Put([]byte("other"), []byte("1")))
+	require.Equal(t, ErrDiskFull, db.Delete([]byte("k")))
+	value, err := db.Get([]byte("k"))
+	require.NoError(t, err)
+	require.Equal(t, []byte(strconv.Itoa(written-1)), value)
+
+	// only the last value of k survives the merge
+	require.NoError(t, db.Merge())
+	require.False(t, db.ReadOnly())
+	require.NoError(t, db.Put([]byte("other"), []byte("1")))
+	require.NoError(t, db.Close())
+
+	db = NewWithOptions(options)
+	require.NoError(t, db.Load())
+	value, err = db.Get([]byte("other"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), value)
+	require.NoError(t, db.Close())
+}
+
+func TestDiskFull(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+	options := DefaultOptions("db")
+	options.FS = fs
+	db := NewWithOptions(options)
+	require.NoError(t, db.Load())
+	require.NoError(t, db.Put([]byte("a"), []byte("1")))
+
+	noSpace := &os.PathError{Op: "write", Path: "db/hint/1.hint", Err: syscall.ENOSPC}
+	fs.Inject(Fault{Op: "write", Path: "db/hint/*.hint", Times: 1, ShortWrite: 3, Err: noSpace})
+	require.Equal(t, ErrDiskFull, db.Put([]byte("b"), []byte("2")))
+	require.True(t, db.ReadOnly())
+	require.Equal(t, ErrDiskFull, db.Put([]byte("c"), []byte("3")))
+	_, err := db.Get([]byte("b"))
+	require.Error(t, err)
+
+	require.NoError(t, db.Merge())
+	require.False(t, db.ReadOnly())
+	require.NoError(t, db.Put([]byte("c"), []byte("3")))
+	require.NoError(t, db.Close())
+
+	// the failed put left nothing behind
+	report, err := NewWithOptions(options).fsck()
+	require.NoError(t, err)
+	require.True(t, report.OK())
+	db = NewWithOptions(options)
+	require.NoError(t, db.Load())
+	_, err = db.Get([]byte("b"))
+	require.Error(t, err)
+	value, err := db.Get([]byte("c"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("3"), value)
+	require.NoError(t, db.Close())
+}
+
+func TestDiskFullOnRotation(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+	options := DefaultOptions("db")
+	options.FS = fs
+	db := NewWithOptions(options)
+	require.NoError(t, db.Load())
+	require.NoError(t, db.Put([]byte("a"), []byte("1")))
+
+	// the next file cannot be started, the active one stays
+	noSpace := &os.PathError{Op: "write", Path: "db/data/2.data", Err: syscall.ENOSPC}
+	fs.Inject(Fault{Op: "write", Path: "db/data/2.data", Times: 1, Err: noSpace})
+	require.Equal(t, ErrDiskFull, db.Merge())
+	require.True(t, db.ReadOnly())
+	require.Equal(t, ErrDiskFull, db.Put([]byte("b"), []byte("2")))
+	value, err := db.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), value)
+	_, err = fs.Stat("db/data/2.data")
+	require.True(t, os.IsNotExist(err))
+
+	require.NoError(t, db.Merge())
+	require.False(t, db.ReadOnly())
+	require.NoError(t, db.Put([]byte("b"), []byte("2")))
+	require.NoError(t, db.Close())
+
+	db = NewWithOptions(options)
+	require.NoError(t, db.Load())
+	value, err = db.Get([]byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), value)
+	require.NoError(t, db.Close())
+}
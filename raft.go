@@ -1,6 +1,7 @@
 package flowdb
 
 import (
+	"fmt"
 	"github.com/hashicorp/raft"
 	raftboltdb "github.com/hashicorp/raft-boltdb"
 	"net"
@@ -10,7 +11,7 @@ import (
 	"time"
 )
 
-func NewRaft(raftAddr, raftId, raftDir string) (*raft.Raft, *FSM, error) {
+func NewRaft(raftAddr, raftId, raftDir string, db *FlowDB) (*raft.Raft, *FSM, error) {
 	config := raft.DefaultConfig()
 	config.LocalID = raft.ServerID(raftId)
 
@@ -34,7 +35,7 @@ func NewRaft(raftAddr, raftId, raftDir string) (*raft.Raft, *FSM, error) {
 	if err != nil {
 		return nil, nil, err
 	}
-	fsm := NewFSM()
+	fsm := NewFSM(db)
 	rf, err := raft.NewRaft(config, fsm, logStore, stableStore, snapshots, transport)
 	if err != nil {
 		return nil, nil, err
@@ -65,3 +66,27 @@ func Bootstrap(rf *raft.Raft, raftAddr, raftId, raftCluster string) {
 	}
 	rf.BootstrapCluster(configuration)
 }
+
+// Apply replicates command data through rf and returns its result once
+// applied. Raft turning it down comes back as ErrNotLeader, ErrTimeout or
+// ErrClosed.
+func Apply(rf *raft.Raft, data []byte, timeout time.Duration) (*ApplyResult, error) {
+	future := rf.Apply(data, timeout)
+	if err := future.Error(); err != nil {
+		return nil, raftError(err)
+	}
+	return future.Response().(*ApplyResult), nil
+}
+
+// raftError wraps the errors of raft in the ones of this package.
+func raftError(err error) error {
+	switch err {
+	case raft.ErrNotLeader, raft.ErrLeadershipLost, raft.ErrLeadershipTransferInProgress:
+		return fmt.Errorf("%w: %v", ErrNotLeader, err)
+	case raft.ErrEnqueueTimeout:
+		return fmt.Errorf("%w: %v", ErrTimeout, err)
+	case raft.ErrRaftShutdown:
+		return fmt.Errorf("%w: %v", ErrClosed, err)
+	}
+	return err
+}
@@ -0,0 +1,241 @@
+package flowdb
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+// RepairReport describes what Repair did
+type RepairReport struct {
+	// Rewritten are the data files whose valid entries were copied into a
+	// fresh file, Rehinted the ones that only got a new hint file
+	Rewritten []int64
+	Rehinted  []int64
+	// Lost are the spans of data that could not be salvaged
+	Lost      []CorruptRange
+	LostBytes int64
+	// Quarantined are the files moved under lost+found
+	Quarantined []string
+	Keys        int
+}
+
+// Repair salvages the data directory of a closed database. A data file with
+// corrupt spans is replaced by a fresh one holding its valid entries, a data
+// file whose hint file is damaged gets a regenerated one, and the replaced
+// files and any orphans are moved to lost+found/<timestamp> for inspection.
+func Repair(directory string) (*RepairReport, error) {
+	db := New(directory)
+	if err := db.useRecordedHasher(); err != nil {
+		return nil, err
+	}
+	if err := db.loadManifest(); err != nil {
+		return nil, err
+	}
+	if err := db.loadBuckets(); err != nil {
+		return nil, err
+	}
+	report := &RepairReport{}
+	lostFound := path.Join(directory, "lost+found", fmt.Sprintf("%d", time.Now().UnixNano()))
+
+	check, err := db.fsck()
+	if err != nil {
+		return nil, err
+	}
+	for _, orphan := range check.Orphans {
+		if err := report.quarantine(db.options.FS, lostFound, orphan); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, id := range db.dataFileIds() {
+		var damage FsckReport
+		if _, err := db.fsckFile(id, &damage, func(*Entry) {}); err != nil {
+			return nil, err
+		}
+		dataDamaged, hintDamaged := false, false
+		for _, r := range damage.Corrupt {
+			if r.File == db.dataFilePath(id) {
+				dataDamaged = true
+				report.Lost = append(report.Lost, r)
+				report.LostBytes += r.End - r.Start
+			} else {
+				hintDamaged = true
+			}
+		}
+
+		if !dataDamaged && !hintDamaged {
+			continue
+		}
+		if err := db.salvageFile(id, dataDamaged); err != nil {
+			return nil, fmt.Errorf("data file %d: %v", id, err)
+		}
+		if err := db.swapSalvaged(id, dataDamaged, lostFound, report); err != nil {
+			return nil, err
+		}
+		if dataDamaged {
+			report.Rewritten = append(report.Rewritten, id)
+		} else {
+			report.Rehinted = append(report.Rehinted, id)
+		}
+	}
+
+	check, err = db.fsck()
+	if err != nil {
+		return nil, err
+	}
+	if !check.OK() {
+		return report, fmt.Errorf("%w: repair left damage behind", ErrCorrupt)
+	}
+	report.Keys = check.Keys
+	return report, nil
+}
+
+// salvageFile writes the valid entries of data file id into a fresh data file
+// and hint file next to the originals, or only the hint file when the data
+// file is kept, and syncs them. A data file with an unreadable header is left
+// to the operator, since its entries cannot be told apart.
+func (f *FlowDB) salvageFile(id int64, rewrite bool) (err error) {
+	src, err := f.options.FS.OpenFile(f.dataFilePath(id), os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	version, start, err := readFileHeader(src, fileKindData)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = f.options.FS.Remove(f.dataFilePath(id) + salvageExt)
+			_ = f.options.FS.Remove(f.hintFilePath(id) + salvageExt)
+		}
+	}()
+
+	hint, err := f.options.FS.OpenFile(f.hintFilePath(id)+salvageExt, FFlag|os.O_TRUNC, FM)
+	if err != nil {
+		return err
+	}
+	defer hint.Close()
+	if err := writeFileHeader(hint, fileKindHint); err != nil {
+		return err
+	}
+	var data File
+	if rewrite {
+		if data, err = f.options.FS.OpenFile(f.dataFilePath(id)+salvageExt, FFlag|os.O_TRUNC, FM); err != nil {
+			return err
+		}
+		defer data.Close()
+		if err := writeFileHeader(data, fileKindData); err != nil {
+			return err
+		}
+	}
+
+	// a kept data file keeps the hashes of its version
+	hashVersion := version
+	if rewrite {
+		hashVersion = formatVersion
+	}
+	offset := int64(fileHeaderSize)
+	var writeErr error
+	err = scanEntries(src, version, start, info.Size(), func(entry *Entry, pos int64) {
+		if writeErr != nil {
+			return
+		}
+		encoded, size := EncodeEntry(entry)
+		if rewrite {
+			if _, writeErr = data.Write(encoded); writeErr != nil {
+				return
+			}
+			pos = offset
+			offset += int64(size)
+		}
+		hintData, _ := EncodeHint(&Hint{
+			Timestamp: entry.Timestamp,
+			ValuePos:  uint64(pos),
+			Key:       f.hintKeyHash(hashVersion, entry.Bucket, entry.Key),
+			ValueSize: size,
+			Bucket:    entry.Bucket,
+			Flags:     entry.Flags,
+		})
+		_, writeErr = hint.Write(hintData)
+	}, func(int64, int64, string) {})
+	if err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	if rewrite {
+		if err := data.Sync(); err != nil {
+			return err
+		}
+	}
+	return hint.Sync()
+}
+
+// salvageExt marks the files salvageFile writes until they replace the
+// originals
+const salvageExt = ".salvage"
+
+// swapSalvaged puts the files written by salvageFile in place of the
+// originals, which are copied to lostFound first. The old hint file goes
+// before the data file is replaced, so if a crash stops the swap, recovery
+// scans whichever data file is in place instead of trusting hints written
+// for the other one.
+func (f *FlowDB) swapSalvaged(id int64, rewrite bool, lostFound string, report *RepairReport) error {
+	fs := f.options.FS
+	dataFile, hintFile := f.dataFilePath(id), f.hintFilePath(id)
+	if rewrite {
+		if err := report.quarantineCopy(fs, lostFound, dataFile); err != nil {
+			return err
+		}
+	}
+	if err := report.quarantineCopy(fs, lostFound, hintFile); err != nil {
+		return err
+	}
+
+	if err := fs.Remove(hintFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if rewrite {
+		if err := fs.Rename(dataFile+salvageExt, dataFile); err != nil {
+			return err
+		}
+	}
+	return fs.Rename(hintFile+salvageExt, hintFile)
+}
+
+// quarantine moves file, a data or hint file of any data directory, to the
+// same data or hint subdirectory under lostFound. Files that do not exist are
+// skipped.
+func (r *RepairReport) quarantine(fs FS, lostFound, file string) error {
+	return r.quarantineFile(fs, lostFound, file, fs.Rename)
+}
+
+// quarantineCopy is quarantine leaving file where it is.
+func (r *RepairReport) quarantineCopy(fs FS, lostFound, file string) error {
+	return r.quarantineFile(fs, lostFound, file, func(from, to string) error {
+		return copyFile(fs, from, to)
+	})
+}
+
+func (r *RepairReport) quarantineFile(fs FS, lostFound, file string, move func(string, string) error) error {
+	if _, err := fs.Stat(file); os.IsNotExist(err) {
+		return nil
+	}
+	target := path.Join(lostFound, path.Base(path.Dir(file)), path.Base(file))
+	if err := fs.MkdirAll(path.Dir(target), FM); err != nil {
+		return err
+	}
+	if err := move(file, target); err != nil {
+		return err
+	}
+	r.Quarantined = append(r.Quarantined, target)
+	return nil
+}
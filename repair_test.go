@@ -0,0 +1,104 @@
+package flowdb
+
+import (
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+	dir := t.TempDir()
+	db := New(dir)
+	require.NoError(t, db.Load())
+	require.NoError(t, db.Put([]byte("a"), []byte("1")))
+	require.NoError(t, db.Put([]byte("b"), []byte("2")))
+	require.NoError(t, db.Put([]byte("c"), []byte("3")))
+	require.NoError(t, db.Close())
+
+	// damage the value of "b", the second entry, and leave an orphan around
+	file := path.Join(dir, "data", "1.data")
+	data, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	size := int64(entryHeaderSize + 2)
+	data[fileHeaderSize+size+entryHeaderSize+1] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(file, data, FM))
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "hint", "7.hint"), nil, FM))
+
+	report, err := Repair(dir)
+	require.NoError(t, err)
+	require.Equal(t, []int64{1}, report.Rewritten)
+	require.Len(t, report.Lost, 1)
+	require.Equal(t, size, report.LostBytes)
+	require.Len(t, report.Quarantined, 3)
+	require.Equal(t, 2, report.Keys)
+	for _, quarantined := range report.Quarantined {
+		_, err := os.Stat(quarantined)
+		require.NoError(t, err)
+	}
+
+	db = New(dir)
+	require.NoError(t, db.Load())
+	_, err = db.Get([]byte("b"))
+	require.Error(t, err)
+	value, err := db.Get([]byte("c"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("3"), value)
+	require.NoError(t, db.Close())
+
+	check, err := Fsck(dir)
+	require.NoError(t, err)
+	require.True(t, check.OK())
+}
+
+func TestRepairHint(t *testing.T) {
+	dir := t.TempDir()
+	db := New(dir)
+	require.NoError(t, db.Load())
+	require.NoError(t, db.Put([]byte("a"), []byte("1")))
+	require.NoError(t, db.Put([]byte("b"), []byte("2")))
+	require.NoError(t, db.Close())
+
+	file := path.Join(dir, "hint", "1.hint")
+	data, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(file, data[:len(data)-3], FM))
+
+	report, err := Repair(dir)
+	require.NoError(t, err)
+	require.Empty(t, report.Rewritten)
+	require.Equal(t, []int64{1}, report.Rehinted)
+	require.Empty(t, report.Lost)
+	require.Equal(t, 2, report.Keys)
+
+	db = New(dir)
+	require.NoError(t, db.Load())
+	value, err := db.Get([]byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), value)
+	require.NoError(t, db.Close())
+}
+
+func TestRepairUnreadableHeader(t *testing.T) {
+	dir := t.TempDir()
+	db := New(dir)
+	require.NoError(t, db.Load())
+	require.NoError(t, db.Put([]byte("a"), []byte("1")))
+	require.NoError(t, db.Close())
+
+	file := path.Join(dir, "data", "1.data")
+	data, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	data[6] = fileKindHint
+	require.NoError(t, ioutil.WriteFile(file, data, FM))
+
+	// the file is left alone rather than replaced by an empty one
+	_, err = Repair(dir)
+	require.Error(t, err)
+	after, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, data, after)
+	_, err = os.Stat(file + salvageExt)
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,524 @@
+package flowdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// DataType tags what an entry value holds. Lists, hashes, sets and sorted
+// sets are kept whole in a single entry and rewritten on every change.
+type DataType uint8
+
+const (
+	TypeString DataType = iota
+	TypeList
+	TypeHash
+	TypeSet
+	TypeZSet
+)
+
+// LPush prepends values to the list under key, the last value ending up
+// first, and returns the new length of the list. Like every list change it
+// copies and rewrites the whole list, so a push costs O(n) in its length.
+func (f *FlowDB) LPush(key []byte, values ...[]byte) (int, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	return f.push(defaultBucket, key, values, true)
+}
+
+// RPush appends values to the list under key and returns its new length.
+func (f *FlowDB) RPush(key []byte, values ...[]byte) (int, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	return f.push(defaultBucket, key, values, false)
+}
+
+// LPop removes and returns the first element of the list under key.
+func (f *FlowDB) LPop(key []byte) ([]byte, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	return f.pop(defaultBucket, key, true)
+}
+
+// RPop removes and returns the last element of the list under key.
+func (f *FlowDB) RPop(key []byte) ([]byte, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	return f.pop(defaultBucket, key, false)
+}
+
+// LRange returns the elements of the list under key between start and stop
+// inclusive. Negative indexes count from the end of the list.
+func (f *FlowDB) LRange(key []byte, start, stop int64) ([][]byte, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.lrange(defaultBucket, key, start, stop)
+}
+
+// HSet sets field of the hash under key and reports whether the field is new.
+func (f *FlowDB) HSet(key, field, value []byte) (bool, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	return f.hset(defaultBucket, key, field, value)
+}
+
+func (f *FlowDB) HGet(key, field []byte) ([]byte, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.hget(defaultBucket, key, field)
+}
+
+// HDel removes field from the hash under key and reports whether it existed.
+func (f *FlowDB) HDel(key, field []byte) (bool, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	return f.hdel(defaultBucket, key, field)
+}
+
+func (f *FlowDB) HGetAll(key []byte) (map[string][]byte, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.loadHash(defaultBucket, key)
+}
+
+// SAdd adds members to the set under key and returns how many were new.
+func (f *FlowDB) SAdd(key []byte, members ...[]byte) (int, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	return f.sadd(defaultBucket, key, members)
+}
+
+// SRem removes members from the set under key and returns how many were
+// there.
+func (f *FlowDB) SRem(key []byte, members ...[]byte) (int, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	return f.srem(defaultBucket, key, members)
+}
+
+// SMembers returns the members of the set under key in order.
+func (f *FlowDB) SMembers(key []byte) ([][]byte, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.smembers(defaultBucket, key)
+}
+
+// ZAdd sets the score of member in the sorted set under key and reports
+// whether the member is new.
+func (f *FlowDB) ZAdd(key []byte, score float64, member []byte) (bool, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	return f.zadd(defaultBucket, key, score, member)
+}
+
+// ZRem removes member from the sorted set under key and reports whether it
+// was there.
+func (f *FlowDB) ZRem(key, member []byte) (bool, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	return f.zrem(defaultBucket, key, member)
+}
+
+// ZRange returns the members of the sorted set under key ranked between start
+// and stop inclusive, lowest score first. Negative ranks count from the end.
+func (f *FlowDB) ZRange(key []byte, start, stop int64) ([][]byte, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.zrange(defaultBucket, key, start, stop)
+}
+
+func (f *FlowDB) push(bucket uint16, key []byte, values [][]byte, left bool) (int, error) {
+	list, err := f.loadList(bucket, key)
+	if err != nil {
+		return 0, err
+	}
+	for _, value := range values {
+		if left {
+			list = append([][]byte{value}, list...)
+		} else {
+			list = append(list, value)
+		}
+	}
+	return len(list), f.storeTyped(bucket, key, TypeList, encodeItems(list), len(list))
+}
+
+func (f *FlowDB) pop(bucket uint16, key []byte, left bool) ([]byte, error) {
+	list, err := f.loadList(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, ErrKeyNotFound
+	}
+	var value []byte
+	if left {
+		value, list = list[0], list[1:]
+	} else {
+		value, list = list[len(list)-1], list[:len(list)-1]
+	}
+	return value, f.storeTyped(bucket, key, TypeList, encodeItems(list), len(list))
+}
+
+func (f *FlowDB) lrange(bucket uint16, key []byte, start, stop int64) ([][]byte, error) {
+	list, err := f.loadList(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	from, to := rangeBounds(int64(len(list)), start, stop)
+	return append(make([][]byte, 0, to-from), list[from:to]...), nil
+}
+
+func (f *FlowDB) hset(bucket uint16, key, field, value []byte) (bool, error) {
+	hash, err := f.loadHash(bucket, key)
+	if err != nil {
+		return false, err
+	}
+	_, exist := hash[string(field)]
+	hash[string(field)] = value
+	return !exist, f.storeTyped(bucket, key, TypeHash, encodeHash(hash), len(hash))
+}
+
+func (f *FlowDB) hget(bucket uint16, key, field []byte) ([]byte, error) {
+	hash, err := f.loadHash(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := hash[string(field)]
+	if !ok {
+		return nil, ErrFieldNotFound
+	}
+	return value, nil
+}
+
+func (f *FlowDB) hdel(bucket uint16, key, field []byte) (bool, error) {
+	hash, err := f.loadHash(bucket, key)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := hash[string(field)]; !ok {
+		return false, nil
+	}
+	delete(hash, string(field))
+	return true, f.storeTyped(bucket, key, TypeHash, encodeHash(hash), len(hash))
+}
+
+func (f *FlowDB) sadd(bucket uint16, key []byte, members [][]byte) (int, error) {
+	set, err := f.loadSet(bucket, key)
+	if err != nil {
+		return 0, err
+	}
+	added := 0
+	for _, member := range members {
+		if _, ok := set[string(member)]; !ok {
+			set[string(member)] = struct{}{}
+			added++
+		}
+	}
+	if added == 0 {
+		return 0, nil
+	}
+	return added, f.storeTyped(bucket, key, TypeSet, encodeSet(set), len(set))
+}
+
+func (f *FlowDB) srem(bucket uint16, key []byte, members [][]byte) (int, error) {
+	set, err := f.loadSet(bucket, key)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, member := range members {
+		if _, ok := set[string(member)]; ok {
+			delete(set, string(member))
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, f.storeTyped(bucket, key, TypeSet, encodeSet(set), len(set))
+}
+
+func (f *FlowDB) smembers(bucket uint16, key []byte) ([][]byte, error) {
+	set, err := f.loadSet(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	members, _ := decodeItems(encodeSet(set))
+	if members == nil {
+		members = [][]byte{}
+	}
+	return members, nil
+}
+
+func (f *FlowDB) zadd(bucket uint16, key []byte, score float64, member []byte) (bool, error) {
+	zset, err := f.loadZSet(bucket, key)
+	if err != nil {
+		return false, err
+	}
+	_, exist := zset[string(member)]
+	zset[string(member)] = score
+	return !exist, f.storeTyped(bucket, key, TypeZSet, encodeZSet(zset), len(zset))
+}
+
+func (f *FlowDB) zrem(bucket uint16, key, member []byte) (bool, error) {
+	zset, err := f.loadZSet(bucket, key)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := zset[string(member)]; !ok {
+		return false, nil
+	}
+	delete(zset, string(member))
+	return true, f.storeTyped(bucket, key, TypeZSet, encodeZSet(zset), len(zset))
+}
+
+func (f *FlowDB) zrange(bucket uint16, key []byte, start, stop int64) ([][]byte, error) {
+	zset, err := f.loadZSet(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	members := sortedZSet(zset)
+	from, to := rangeBounds(int64(len(members)), start, stop)
+	result := make([][]byte, 0, to-from)
+	for _, member := range members[from:to] {
+		result = append(result, []byte(member))
+	}
+	return result, nil
+}
+
+// loadTyped reads the value under key and checks it holds t. A missing key
+// reads as an empty value.
+func (f *FlowDB) loadTyped(bucket uint16, key []byte, t DataType) ([]byte, error) {
+	entry, err := f.lookup(bucket, key)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	if entry.Type != t {
+		return nil, ErrWrongType
+	}
+	return entry.Value, nil
+}
+
+// storeTyped writes a structure back, deleting the key once it is empty. The
+// caller must hold f.writeMu, from before it loaded the structure, or f.mu
+// exclusively.
+func (f *FlowDB) storeTyped(bucket uint16, key []byte, t DataType, value []byte, length int) error {
+	if length == 0 {
+		return f.deleteLocked(bucket, key)
+	}
+	return f.putLocked(bucket, key, value, t)
+}
+
+func (f *FlowDB) loadList(bucket uint16, key []byte) ([][]byte, error) {
+	data, err := f.loadTyped(bucket, key, TypeList)
+	if err != nil {
+		return nil, err
+	}
+	return decodeItems(data)
+}
+
+func (f *FlowDB) loadHash(bucket uint16, key []byte) (map[string][]byte, error) {
+	data, err := f.loadTyped(bucket, key, TypeHash)
+	if err != nil {
+		return nil, err
+	}
+	items, err := decodeItems(data)
+	if err != nil {
+		return nil, err
+	}
+	hash := make(map[string][]byte, len(items)/2)
+	for i := 0; i+1 < len(items); i += 2 {
+		hash[string(items[i])] = items[i+1]
+	}
+	return hash, nil
+}
+
+func (f *FlowDB) loadSet(bucket uint16, key []byte) (map[string]struct{}, error) {
+	data, err := f.loadTyped(bucket, key, TypeSet)
+	if err != nil {
+		return nil, err
+	}
+	items, err := decodeItems(data)
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]struct{}, len(items))
+	for _, item := range items {
+		set[string(item)] = struct{}{}
+	}
+	return set, nil
+}
+
+func (f *FlowDB) loadZSet(bucket uint16, key []byte) (map[string]float64, error) {
+	data, err := f.loadTyped(bucket, key, TypeZSet)
+	if err != nil {
+		return nil, err
+	}
+	items, err := decodeItems(data)
+	if err != nil {
+		return nil, err
+	}
+	zset := make(map[string]float64, len(items))
+	for _, item := range items {
+		if len(item) < 8 {
+			return nil, fmt.Errorf("%w: sorted set", ErrCorrupt)
+		}
+		zset[string(item[8:])] = math.Float64frombits(binary.BigEndian.Uint64(item[:8]))
+	}
+	return zset, nil
+}
+
+// encodeItems packs a list of byte strings
+// | COUNT 4 | LEN 4 | ITEM ? | LEN 4 | ITEM ? | ...
+func encodeItems(items [][]byte) []byte {
+	size := 4
+	for _, item := range items {
+		size += 4 + len(item)
+	}
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(items)))
+	pos := 4
+	for _, item := range items {
+		binary.BigEndian.PutUint32(buf[pos:pos+4], uint32(len(item)))
+		copy(buf[pos+4:], item)
+		pos += 4 + len(item)
+	}
+	return buf
+}
+
+func decodeItems(data []byte) ([][]byte, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if len(data) < 4 {
+		return nil, fmt.Errorf("%w: items", ErrCorrupt)
+	}
+	count := binary.BigEndian.Uint32(data[:4])
+	items := make([][]byte, 0, count)
+	pos := 4
+	for i := uint32(0); i < count; i++ {
+		if pos+4 > len(data) {
+			return nil, fmt.Errorf("%w: items", ErrCorrupt)
+		}
+		size := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		if pos+4+size > len(data) {
+			return nil, fmt.Errorf("%w: items", ErrCorrupt)
+		}
+		items = append(items, data[pos+4:pos+4+size])
+		pos += 4 + size
+	}
+	return items, nil
+}
+
+// encodeHash stores fields and values alternately, sorted by field
+func encodeHash(hash map[string][]byte) []byte {
+	fields := make([]string, 0, len(hash))
+	for field := range hash {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	items := make([][]byte, 0, 2*len(fields))
+	for _, field := range fields {
+		items = append(items, []byte(field), hash[field])
+	}
+	return encodeItems(items)
+}
+
+func encodeSet(set map[string]struct{}) []byte {
+	members := make([]string, 0, len(set))
+	for member := range set {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	items := make([][]byte, len(members))
+	for i, member := range members {
+		items[i] = []byte(member)
+	}
+	return encodeItems(items)
+}
+
+// encodeZSet stores each member behind its 8 byte score, in rank order
+func encodeZSet(zset map[string]float64) []byte {
+	members := sortedZSet(zset)
+	items := make([][]byte, len(members))
+	for i, member := range members {
+		item := make([]byte, 8+len(member))
+		binary.BigEndian.PutUint64(item[:8], math.Float64bits(zset[member]))
+		copy(item[8:], member)
+		items[i] = item
+	}
+	return encodeItems(items)
+}
+
+// sortedZSet returns the members ordered by score, then by member.
+func sortedZSet(zset map[string]float64) []string {
+	members := make([]string, 0, len(zset))
+	for member := range zset {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if zset[members[i]] != zset[members[j]] {
+			return zset[members[i]] < zset[members[j]]
+		}
+		return members[i] < members[j]
+	})
+	return members
+}
+
+// rangeBounds turns inclusive, possibly negative, start and stop indexes into
+// slice bounds of a sequence of length n.
+func rangeBounds(n, start, stop int64) (int64, int64) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop {
+		return 0, 0
+	}
+	return start, stop + 1
+}
@@ -0,0 +1,120 @@
+package flowdb
+
+import (
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestList(t *testing.T) {
+	db := New(t.TempDir())
+	require.NoError(t, db.Load())
+
+	n, err := db.LPush([]byte("l"), []byte("b"), []byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	n, err = db.RPush([]byte("l"), []byte("c"))
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+
+	values, err := db.LRange([]byte("l"), 0, -1)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("a"), []byte("b"), []byte("c")}, values)
+	values, err = db.LRange([]byte("l"), -2, 10)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("b"), []byte("c")}, values)
+
+	value, err := db.RPop([]byte("l"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("c"), value)
+	value, err = db.LPop([]byte("l"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), value)
+	_, err = db.LPop([]byte("l"))
+	require.NoError(t, err)
+	_, err = db.LPop([]byte("l"))
+	require.Error(t, err)
+
+	// structures are not plain values
+	_, err = db.LPush([]byte("l2"), []byte("x"))
+	require.NoError(t, err)
+	_, err = db.Get([]byte("l2"))
+	require.Error(t, err)
+	require.NoError(t, db.Put([]byte("s"), []byte("plain")))
+	_, err = db.LPush([]byte("s"), []byte("x"))
+	require.Error(t, err)
+	require.NoError(t, db.Close())
+}
+
+func TestHashSetZSet(t *testing.T) {
+	dir := t.TempDir()
+	db := New(dir)
+	require.NoError(t, db.Load())
+
+	added, err := db.HSet([]byte("h"), []byte("name"), []byte("alice"))
+	require.NoError(t, err)
+	require.True(t, added)
+	added, err = db.HSet([]byte("h"), []byte("name"), []byte("bob"))
+	require.NoError(t, err)
+	require.False(t, added)
+	_, err = db.HSet([]byte("h"), []byte("age"), []byte("30"))
+	require.NoError(t, err)
+	removed, err := db.HDel([]byte("h"), []byte("age"))
+	require.NoError(t, err)
+	require.True(t, removed)
+
+	n, err := db.SAdd([]byte("s"), []byte("b"), []byte("a"), []byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	n, err = db.SRem([]byte("s"), []byte("b"), []byte("c"))
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	_, err = db.ZAdd([]byte("z"), 3, []byte("c"))
+	require.NoError(t, err)
+	_, err = db.ZAdd([]byte("z"), 1, []byte("a"))
+	require.NoError(t, err)
+	_, err = db.ZAdd([]byte("z"), 2, []byte("b"))
+	require.NoError(t, err)
+	removed, err = db.ZRem([]byte("z"), []byte("b"))
+	require.NoError(t, err)
+	require.True(t, removed)
+	require.NoError(t, db.Close())
+
+	// structures survive a restart
+	db = New(dir)
+	require.NoError(t, db.Load())
+	value, err := db.HGet([]byte("h"), []byte("name"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("bob"), value)
+	hash, err := db.HGetAll([]byte("h"))
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{"name": []byte("bob")}, hash)
+	members, err := db.SMembers([]byte("s"))
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("a")}, members)
+	members, err = db.ZRange([]byte("z"), 0, -1)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("a"), []byte("c")}, members)
+	require.NoError(t, db.Close())
+}
+
+func TestStructureCommands(t *testing.T) {
+	db := New(t.TempDir())
+	require.NoError(t, db.Load())
+	fsm := NewFSM(db)
+
+	data, err := EncodeCommand(&Command{Op: OpRPush, Key: []byte("q"), Members: [][]byte{[]byte("a"), []byte("b")}})
+	require.NoError(t, err)
+	result := fsm.Apply(&raft.Log{Index: 1, Data: data}).(*ApplyResult)
+	require.NoError(t, result.Err)
+	require.Equal(t, []byte("2"), result.Value)
+
+	result = db.Query(&Command{Op: OpLRange, Key: []byte("q"), Start: 0, Stop: -1})
+	require.NoError(t, result.Err)
+	require.Equal(t, [][]byte{[]byte("a"), []byte("b")}, result.Values)
+
+	result = db.Query(&Command{Op: OpLPop, Key: []byte("q")})
+	require.Error(t, result.Err)
+	require.NoError(t, db.Close())
+}
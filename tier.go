@@ -0,0 +1,184 @@
+package flowdb
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// Tier moves the data files that have gone cold to Options.ColdDirectory:
+// those whose newest entry is older than Options.ColdAge, and the oldest
+// ones beyond Options.HotSizeBudget. Each file is copied while reads and
+// writes go on, then swapped in under a short exclusive lock, so Get keeps
+// working throughout. It returns how many files it moved.
+func (f *FlowDB) Tier() (int, error) {
+	if err := f.writable(); err != nil {
+		return 0, err
+	}
+	if f.options.ColdDirectory == "" {
+		return 0, ErrTierNotConfigured
+	}
+	ids, err := f.coldFiles()
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, id := range ids {
+		ok, err := f.moveCold(id)
+		if err != nil {
+			return moved, err
+		}
+		if ok {
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+// coldFiles returns the ids of the data files Tier has to move, oldest first.
+func (f *FlowDB) coldFiles() ([]int64, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	f.writeMu.Lock()
+	active := f.dataFileVersion
+	f.writeMu.Unlock()
+
+	cold := path.Clean(f.options.ColdDirectory)
+	var hot []int64
+	for _, id := range f.openFileIds() {
+		if id < active && path.Clean(f.fileDir(id)) != cold {
+			hot = append(hot, id)
+		}
+	}
+
+	cutoff := uint64(time.Now().Add(-f.options.ColdAge).UnixMicro())
+	var ids []int64
+	var size int64
+	// newest first, so the budget is spent on the most recent files
+	for i := len(hot) - 1; i >= 0; i-- {
+		id := hot[i]
+		if f.options.ColdAge > 0 {
+			newest, err := f.newestTimestamp(id)
+			if err != nil {
+				return nil, err
+			}
+			if newest < cutoff {
+				ids = append(ids, id)
+				continue
+			}
+		}
+		fd, _, ok := f.dataFile(id)
+		if !ok {
+			continue
+		}
+		info, err := fd.Stat()
+		if err != nil {
+			return nil, err
+		}
+		size += info.Size()
+		if f.options.HotSizeBudget > 0 && size > f.options.HotSizeBudget {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// newestTimestamp returns the timestamp of the newest entry of a data file
+// according to its hints. A file whose hint file is missing or does not check
+// out counts as new, so it stays where it is.
+func (f *FlowDB) newestTimestamp(id int64) (uint64, error) {
+	if _, err := f.options.FS.Stat(f.hintFilePath(id)); os.IsNotExist(err) {
+		return uint64(time.Now().UnixMicro()), nil
+	}
+	var newest uint64
+	err := f.forEachHint(id, func(hint *Hint) error {
+		if hint.Timestamp > newest {
+			newest = hint.Timestamp
+		}
+		return nil
+	})
+	if err == errCorruptHint {
+		return uint64(time.Now().UnixMicro()), nil
+	}
+	return newest, err
+}
+
+// moveCold copies data file id and its hint file to the cold directory and
+// switches over to the copies. It reports false when the file was merged
+// away in the meantime.
+func (f *FlowDB) moveCold(id int64) (bool, error) {
+	cold := f.options.ColdDirectory
+	f.mu.RLock()
+	if _, _, ok := f.dataFile(id); !ok {
+		f.mu.RUnlock()
+		return false, nil
+	}
+	data, hint := f.dataFilePath(id), f.hintFilePath(id)
+	coldData := path.Join(cold, "data", path.Base(data))
+	coldHint := path.Join(cold, "hint", path.Base(hint))
+	err := copyFile(f.options.FS, data, coldData)
+	if err == nil {
+		err = copyFile(f.options.FS, hint, coldHint)
+	}
+	f.mu.RUnlock()
+	if err != nil {
+		return false, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	old, version, ok := f.dataFile(id)
+	if !ok {
+		_ = f.options.FS.Remove(coldData)
+		_ = f.options.FS.Remove(coldHint)
+		return false, nil
+	}
+	fd, err := f.options.FS.OpenFile(coldData, os.O_RDONLY, 0)
+	if err != nil {
+		return false, err
+	}
+	// from here on recovery finds the copies and ignores the originals
+	if err := f.moveFile(id, cold); err != nil {
+		_ = fd.Close()
+		return false, err
+	}
+	f.addDataFile(id, fd, version)
+	_ = old.Close()
+	if err := f.options.FS.Remove(data); err != nil {
+		return true, err
+	}
+	if err := f.options.FS.Remove(hint); err != nil && !os.IsNotExist(err) {
+		return true, err
+	}
+	return true, nil
+}
+
+// copyFile copies from to a new file to on fs and syncs it. A missing from is
+// not an error, hint files being optional.
+func copyFile(fs FS, from, to string) error {
+	src, err := fs.OpenFile(from, os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := fs.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, FM)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		_ = dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		_ = dst.Close()
+		return err
+	}
+	return dst.Close()
+}
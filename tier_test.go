@@ -0,0 +1,96 @@
+package flowdb
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ingestedDB returns a database on fs whose keys k:000 to k:049 sit in
+// several immutable data files.
+func ingestedDB(t *testing.T, options Options) *FlowDB {
+	db := NewWithOptions(options)
+	require.NoError(t, db.Load())
+	b, err := NewBuilder(Options{DatabaseDirectory: "build", FS: options.FS})
+	require.NoError(t, err)
+	b.fileSize = 256
+	for i := 0; i < 50; i++ {
+		require.NoError(t, b.Add([]byte(fmt.Sprintf("k:%03d", i)), []byte(fmt.Sprintf("v%d", i))))
+	}
+	require.NoError(t, b.Close())
+	require.NoError(t, db.Ingest("build"))
+	return db
+}
+
+func TestTierHotSizeBudget(t *testing.T) {
+	options := DefaultOptions("db")
+	options.FS = NewMemFS()
+	options.ColdDirectory = "cold"
+	options.HotSizeBudget = 300
+	db := ingestedDB(t, options)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			value, err := db.Get([]byte(fmt.Sprintf("k:%03d", i%50)))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("v%d", i%50)), value)
+		}
+	}()
+	moved, err := db.Tier()
+	require.NoError(t, err)
+	wg.Wait()
+
+	// only the newest immutable file fits the budget
+	ids := db.openFileIds()
+	require.Equal(t, len(ids)-2, moved)
+	for _, id := range ids[:len(ids)-2] {
+		require.Equal(t, "cold", db.fileDir(id))
+	}
+	require.Equal(t, "db", db.fileDir(ids[len(ids)-2]))
+	moved, err = db.Tier()
+	require.NoError(t, err)
+	require.Equal(t, 0, moved)
+	require.NoError(t, db.Close())
+
+	db = NewWithOptions(options)
+	require.NoError(t, db.Load())
+	require.Equal(t, 50, db.keydir.len())
+	value, err := db.Get([]byte("k:000"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v0"), value)
+	require.NoError(t, db.Close())
+	_, err = options.FS.Stat(path.Join("db", "data", "2.data"))
+	require.Error(t, err)
+}
+
+func TestTierColdAge(t *testing.T) {
+	options := DefaultOptions("db")
+	options.FS = NewMemFS()
+	options.ColdDirectory = "cold"
+	options.ColdAge = time.Hour
+	db := ingestedDB(t, options)
+
+	moved, err := db.Tier()
+	require.NoError(t, err)
+	// only the first file, which holds no entries, is old enough
+	require.Equal(t, 1, moved)
+	require.Equal(t, "cold", db.fileDir(1))
+
+	// a file whose hint file is gone counts as new and stays
+	ids := db.openFileIds()
+	require.NoError(t, options.FS.Remove(path.Join("db", "hint", fmt.Sprintf("%d.hint", ids[1]))))
+	db.options.ColdAge = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	moved, err = db.Tier()
+	require.NoError(t, err)
+	require.Equal(t, len(ids)-3, moved)
+	require.Equal(t, "db", db.fileDir(ids[1]))
+	require.Equal(t, "cold", db.fileDir(ids[2]))
+	require.NoError(t, db.Close())
+}
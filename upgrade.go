@@ -0,0 +1,226 @@
+package flowdb
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+// UpgradeReport describes what Upgrade did
+type UpgradeReport struct {
+	Files    int
+	Entries  int
+	Keys     int
+	Backup   string
+	UpToDate bool
+}
+
+// Upgrade rewrites the data directory of a closed database in the current
+// format. Every entry is CRC checked while it is copied into a sibling
+// directory, the copy is loaded to check it holds the same number of keys,
+// and only then the original directory is renamed to a backup and the copy
+// takes its place. Files kept in other data directories are gathered into
+// the copy, and moved into the backup once the copy checks out, so both are
+// whole databases in a single directory.
+func Upgrade(directory string) (*UpgradeReport, error) {
+	old := New(directory)
+	if err := old.useRecordedHasher(); err != nil {
+		return nil, err
+	}
+	if err := old.loadManifest(); err != nil {
+		return nil, err
+	}
+	if err := old.loadBuckets(); err != nil {
+		return nil, err
+	}
+	ids := old.dataFileIds()
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no data files in %s", directory)
+	}
+	defer func() {
+		for _, fd := range old.fileList {
+			_ = fd.Close()
+		}
+	}()
+
+	report := &UpgradeReport{Files: len(ids), UpToDate: true}
+	for _, id := range ids {
+		fd, err := old.options.FS.OpenFile(old.dataFilePath(id), os.O_RDONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		old.fileList[id] = fd
+		version, _, err := readFileHeader(fd, fileKindData)
+		if err != nil {
+			return nil, fmt.Errorf("data file %d: %v", id, err)
+		}
+		old.fileVersions[id] = version
+		if version != formatVersion {
+			report.UpToDate = false
+		}
+	}
+	if report.UpToDate {
+		return report, nil
+	}
+
+	target := path.Clean(directory) + ".upgrade"
+	fs := old.options.FS
+	if err := fs.RemoveAll(target); err != nil {
+		return nil, err
+	}
+	converted := NewWithOptions(Options{DatabaseDirectory: target, FS: fs, Hasher: old.options.Hasher})
+	for _, dir := range []string{"data", "hint"} {
+		if err := fs.MkdirAll(path.Join(target, dir), FM); err != nil {
+			return nil, err
+		}
+	}
+
+	live := make(keyCounter)
+	for _, id := range ids {
+		err := converted.convertFile(old, id, func(entry *Entry) {
+			report.Entries++
+			live.add(old, entry)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("data file %d: %v", id, err)
+		}
+	}
+	report.Keys = len(live)
+	if err := copyMetadata(fs, directory, target); err != nil {
+		return nil, err
+	}
+
+	check := NewWithOptions(Options{DatabaseDirectory: target, FS: fs, Hasher: old.options.Hasher})
+	if err := check.Load(); err != nil {
+		return nil, fmt.Errorf("upgraded copy: %v", err)
+	}
+	keys := check.keydir.len()
+	if err := check.Close(); err != nil {
+		return nil, err
+	}
+	if keys != report.Keys {
+		return nil, fmt.Errorf("upgraded copy has %d keys, expected %d", keys, report.Keys)
+	}
+
+	report.Backup = fmt.Sprintf("%s.bak-%d", path.Clean(directory), time.Now().Unix())
+	if err := fs.Rename(directory, report.Backup); err != nil {
+		return nil, err
+	}
+	if err := fs.Rename(target, directory); err != nil {
+		return nil, err
+	}
+	if err := old.collectFiles(ids, report.Backup); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// collectFiles moves the files of ids kept in other data directories into
+// the backup. They are copied first, then the manifest pointing at them is
+// dropped, and only then are the originals removed, so the backup can be
+// opened whenever a crash stops the move.
+func (f *FlowDB) collectFiles(ids []int64, backup string) error {
+	fs := f.options.FS
+	var moved []int64
+	for _, id := range ids {
+		if _, ok := f.manifest.Files[id]; !ok {
+			continue
+		}
+		for _, file := range []string{f.dataFilePath(id), f.hintFilePath(id)} {
+			kind := path.Base(path.Dir(file))
+			if err := copyFile(fs, file, path.Join(backup, kind, path.Base(file))); err != nil {
+				return err
+			}
+		}
+		moved = append(moved, id)
+	}
+	if len(moved) == 0 {
+		return nil
+	}
+
+	if err := fs.Remove(path.Join(backup, manifestFileName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, id := range moved {
+		for _, file := range []string{f.dataFilePath(id), f.hintFilePath(id)} {
+			if err := fs.Remove(file); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// convertFile copies the entries of data file id of old into a new data and
+// hint file pair in the current format, calling fn with each one.
+func (f *FlowDB) convertFile(old *FlowDB, id int64, fn func(*Entry)) error {
+	fd, err := f.openDataFile(id)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	hint, err := f.openHintFile(id)
+	if err != nil {
+		return err
+	}
+	defer hint.Close()
+	if err := writeFileHeader(fd, fileKindData); err != nil {
+		return err
+	}
+	if err := writeFileHeader(hint, fileKindHint); err != nil {
+		return err
+	}
+
+	offset := int64(fileHeaderSize)
+	err = old.forEachEntry(id, func(entry *Entry, _ int64) error {
+		data, size := EncodeEntry(entry)
+		if _, err := fd.Write(data); err != nil {
+			return err
+		}
+		hintData, _ := EncodeHint(&Hint{
+			Timestamp: entry.Timestamp,
+			ValuePos:  uint64(offset),
+			Key:       f.keyHash(entry.Bucket, entry.Key),
+			ValueSize: size,
+			Bucket:    entry.Bucket,
+			Flags:     entry.Flags,
+		})
+		if _, err := hint.Write(hintData); err != nil {
+			return err
+		}
+		offset += int64(size)
+		fn(entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := fd.Sync(); err != nil {
+		return err
+	}
+	return hint.Sync()
+}
+
+// copyMetadata copies the files kept next to the data and hint directories,
+// such as the bucket registry. The manifest stays behind, since the copy
+// holds every data file itself.
+func copyMetadata(fs FS, from, to string) error {
+	files, err := fs.ReadDir(from)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !file.Mode().IsRegular() || file.Name() == manifestFileName {
+			continue
+		}
+		data, err := readFile(fs, path.Join(from, file.Name()))
+		if err != nil {
+			return err
+		}
+		if err := writeFile(fs, path.Join(to, file.Name()), data, file.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
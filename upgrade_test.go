@@ -0,0 +1,95 @@
+package flowdb
+
+import (
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestUpgrade(t *testing.T) {
+	dir := path.Join(t.TempDir(), "db")
+	writeV1Files(t, dir, 1, []*Entry{
+		{Timestamp: 1, Key: []byte("a"), Value: []byte("1")},
+		{Timestamp: 2, Key: []byte("b"), Value: []byte("2")},
+		{Timestamp: 3, Key: []byte("a"), Flags: flagTombstone},
+	})
+	writeV1Files(t, dir, 2, []*Entry{
+		{Timestamp: 4, Key: []byte("c"), Value: []byte("3")},
+	})
+
+	report, err := Upgrade(dir)
+	require.NoError(t, err)
+	require.False(t, report.UpToDate)
+	require.Equal(t, 2, report.Files)
+	require.Equal(t, 4, report.Entries)
+	require.Equal(t, 2, report.Keys)
+	_, err = os.Stat(path.Join(report.Backup, "data", "1.data"))
+	require.NoError(t, err)
+
+	db := New(dir)
+	require.NoError(t, db.Load())
+	for _, id := range db.dataFileIds() {
+		require.Equal(t, formatVersion, db.fileVersions[id])
+	}
+	_, err = db.Get([]byte("a"))
+	require.Error(t, err)
+	value, err := db.Get([]byte("c"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("3"), value)
+	require.NoError(t, db.Close())
+
+	report, err = Upgrade(dir)
+	require.NoError(t, err)
+	require.True(t, report.UpToDate)
+}
+
+func TestUpgradeCorrupt(t *testing.T) {
+	dir := path.Join(t.TempDir(), "db")
+	writeV1Files(t, dir, 1, []*Entry{
+		{Timestamp: 1, Key: []byte("a"), Value: []byte("1")},
+	})
+	file := path.Join(dir, "data", "1.data")
+	data, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(file, data, FM))
+
+	_, err = Upgrade(dir)
+	require.Error(t, err)
+	// the original directory is left alone
+	after, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, data, after)
+}
+
+func TestUpgradeDataDirectories(t *testing.T) {
+	root := t.TempDir()
+	dir := path.Join(root, "db")
+	writeV1Files(t, dir, 1, []*Entry{
+		{Timestamp: 1, Key: []byte("a"), Value: []byte("1")},
+	})
+	options := DefaultOptions(dir)
+	options.DataDirectories = []string{path.Join(root, "disk1"), path.Join(root, "disk2")}
+	db := NewWithOptions(options)
+	require.NoError(t, db.Load())
+	require.NoError(t, db.Put([]byte("b"), []byte("2")))
+	require.NoError(t, db.Close())
+	require.Equal(t, path.Join(root, "disk1"), db.fileDir(2))
+
+	report, err := Upgrade(dir)
+	require.NoError(t, err)
+	require.Equal(t, 2, report.Keys)
+
+	// nothing is left in the other directory, the backup has it all
+	files, err := ioutil.ReadDir(path.Join(root, "disk1", "data"))
+	require.NoError(t, err)
+	require.Empty(t, files)
+	for _, d := range []string{dir, report.Backup} {
+		check, err := Fsck(d)
+		require.NoError(t, err)
+		require.True(t, check.OK())
+		require.Equal(t, 2, check.Keys)
+	}
+}
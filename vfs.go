@@ -0,0 +1,95 @@
+package flowdb
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// FS is the file system FlowDB keeps its files on. Names are slash separated
+// paths as built by the path package.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	ReadDir(dir string) ([]os.FileInfo, error)
+	MkdirAll(dir string, perm os.FileMode) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	Rename(oldName, newName string) error
+	Stat(name string) (os.FileInfo, error)
+}
+
+// File is a file opened through an FS
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+	Sync() error
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+}
+
+// OSFS is the file system of the operating system
+var OSFS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fd, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+func (osFS) ReadDir(dir string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dir)
+}
+
+func (osFS) MkdirAll(dir string, perm os.FileMode) error {
+	return os.MkdirAll(dir, perm)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) RemoveAll(name string) error {
+	return os.RemoveAll(name)
+}
+
+func (osFS) Rename(oldName, newName string) error {
+	return os.Rename(oldName, newName)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// readFile reads the whole of name from fs.
+func readFile(fs FS, name string) ([]byte, error) {
+	fd, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return ioutil.ReadAll(fd)
+}
+
+// writeFile replaces the content of name on fs with data.
+func writeFile(fs FS, name string, data []byte, perm os.FileMode) error {
+	fd, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := fd.Write(data); err != nil {
+		_ = fd.Close()
+		return err
+	}
+	if err := fd.Sync(); err != nil {
+		_ = fd.Close()
+		return err
+	}
+	return fd.Close()
+}
@@ -0,0 +1,109 @@
+package flowdb
+
+import "bytes"
+
+const defaultWatchBufferSize = 1024
+
+type EventType uint8
+
+const (
+	EventPut EventType = iota
+	EventDelete
+)
+
+// Event describes a committed write seen by a Watcher
+type Event struct {
+	Type      EventType
+	DataType  DataType
+	Key       []byte
+	Value     []byte
+	Timestamp int64
+}
+
+// Watcher delivers the events of the keys under a prefix on C. When a slow
+// reader lets C fill up, the watcher gives up: C is closed and Err reports
+// ErrWatchOverflow, so the reader knows it has to resync before watching again.
+type Watcher struct {
+	C <-chan Event
+
+	ch     chan Event
+	bucket uint16
+	prefix []byte
+	db     *FlowDB
+	err    error
+}
+
+// Watch returns a watcher receiving every put and delete of a key starting
+// with prefix, after the write has been committed.
+func (f *FlowDB) Watch(prefix []byte) *Watcher {
+	return f.watch(defaultBucket, prefix)
+}
+
+func (f *FlowDB) watch(bucket uint16, prefix []byte) *Watcher {
+	ch := make(chan Event, f.options.WatchBufferSize)
+	w := &Watcher{
+		C:      ch,
+		ch:     ch,
+		bucket: bucket,
+		prefix: append([]byte(nil), prefix...),
+		db:     f,
+	}
+
+	f.watchMu.Lock()
+	defer f.watchMu.Unlock()
+	f.watchers[w] = struct{}{}
+	return w
+}
+
+// Close stops the watcher and closes C.
+func (w *Watcher) Close() {
+	w.db.watchMu.Lock()
+	defer w.db.watchMu.Unlock()
+
+	w.db.removeWatcher(w, nil)
+}
+
+// Err returns why C was closed by the database, or nil if it was closed by
+// Close. It is only meaningful once C is closed.
+func (w *Watcher) Err() error {
+	return w.err
+}
+
+// notify hands an event to the matching watchers without ever blocking the
+// writer.
+func (f *FlowDB) notify(bucket uint16, event Event) {
+	f.watchMu.Lock()
+	defer f.watchMu.Unlock()
+
+	for w := range f.watchers {
+		if w.bucket != bucket || !bytes.HasPrefix(event.Key, w.prefix) {
+			continue
+		}
+		select {
+		case w.ch <- event:
+		default:
+			f.removeWatcher(w, ErrWatchOverflow)
+		}
+	}
+}
+
+// closeWatchers stops every watcher, reporting err to their readers.
+func (f *FlowDB) closeWatchers(err error) {
+	f.watchMu.Lock()
+	defer f.watchMu.Unlock()
+
+	for w := range f.watchers {
+		f.removeWatcher(w, err)
+	}
+}
+
+// removeWatcher unregisters w and closes its channel. The caller must hold
+// f.watchMu.
+func (f *FlowDB) removeWatcher(w *Watcher, err error) {
+	if _, ok := f.watchers[w]; !ok {
+		return
+	}
+	delete(f.watchers, w)
+	w.err = err
+	close(w.ch)
+}
@@ -0,0 +1,66 @@
+package flowdb
+
+import (
+	"github.com/stretchr/testify/require"
+	"strconv"
+	"testing"
+)
+
+func TestWatch(t *testing.T) {
+	db := New(t.TempDir())
+	require.NoError(t, db.Load())
+
+	w := db.Watch([]byte("user:"))
+	require.NoError(t, db.Put([]byte("user:1"), []byte("alice")))
+	require.NoError(t, db.Put([]byte("order:1"), []byte("book")))
+	require.NoError(t, db.Delete([]byte("user:1")))
+
+	event := <-w.C
+	require.Equal(t, EventPut, event.Type)
+	require.Equal(t, []byte("user:1"), event.Key)
+	require.Equal(t, []byte("alice"), event.Value)
+	event = <-w.C
+	require.Equal(t, EventDelete, event.Type)
+	require.Equal(t, []byte("user:1"), event.Key)
+
+	w.Close()
+	_, ok := <-w.C
+	require.False(t, ok)
+	require.NoError(t, w.Err())
+	require.NoError(t, db.Close())
+}
+
+func TestWatchOverflow(t *testing.T) {
+	options := DefaultOptions(t.TempDir())
+	options.WatchBufferSize = 2
+	db := NewWithOptions(options)
+	require.NoError(t, db.Load())
+
+	w := db.Watch(nil)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, db.Put([]byte("k:"+strconv.Itoa(i)), []byte("v")))
+	}
+	for range w.C {
+	}
+	require.Equal(t, ErrWatchOverflow, w.Err())
+	require.NoError(t, db.Close())
+}
+
+func TestWatchBufferSize(t *testing.T) {
+	// options left zero buffer like the defaults
+	db := NewWithOptions(Options{DatabaseDirectory: "db", FS: NewMemFS()})
+	require.NoError(t, db.Load())
+	w := db.Watch(nil)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, db.Put([]byte("k:"+strconv.Itoa(i)), []byte("v")))
+	}
+	require.Len(t, w.C, 3)
+	w.Close()
+	require.NoError(t, w.Err())
+	require.NoError(t, db.Close())
+
+	options := DefaultOptions("db")
+	options.FS = NewMemFS()
+	options.WatchBufferSize = -1
+	require.Error(t, NewWithOptions(options).Load())
+}